@@ -1,46 +1,166 @@
 package main
 
-import "sync"
+import (
+	"fmt"
+	"hash/maphash"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 type Client interface {
 	Get(address string) (string, error)
 }
 
+// BatchClient is a Client whose backend also offers a bulk endpoint
+// GetMany returns one body and one error per address, in the order of addresses
+type BatchClient interface {
+	Client
+	GetMany(addresses []string) ([]string, []error)
+}
+
+// PanicError is returned to every caller waiting on a fetch whose Client.Get panicked
+// It keeps the recovered value and the stack of the fetching goroutine
+type PanicError struct {
+	Value any
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("client panicked: %v\n\n%s", e.Value, e.Stack)
+}
+
+// Option configures a Cache
+type Option func(*Cache)
+
+// WithRepanic makes every caller waiting on a panicked fetch panic with the *PanicError
+// instead of receiving it as an error
+func WithRepanic() Option {
+	return func(c *Cache) {
+		c.repanic = true
+	}
+}
+
+// WithRefreshAhead enables refresh-ahead mode
+// Once an entry is older than softTTL, the next Get reloads it in the background
+// and keeps serving the stale value until the reload completes
+func WithRefreshAhead(softTTL time.Duration) Option {
+	return func(c *Cache) {
+		c.softTTL = softTTL
+	}
+}
+
+// WithShards splits the cache into n independently locked shards
+// Addresses are assigned to shards by hash, so callers for different addresses
+// rarely contend on the same mutex. The default is a single shard
+func WithShards(n int) Option {
+	return func(c *Cache) {
+		if n > 0 {
+			c.shards = make([]*shard, n)
+		}
+	}
+}
+
+// WithBatching collects misses arriving within window, or up to maxBatch of them,
+// into a single BatchClient.GetMany call. It has no effect if the client is not a BatchClient
+// A maxBatch <= 0 means batches are only bounded by the window
+func WithBatching(window time.Duration, maxBatch int) Option {
+	return func(c *Cache) {
+		c.batchWindow, c.maxBatch = window, maxBatch
+	}
+}
+
 // Cache is a non-blocking cache that caches the result of a Get call
-// It uses a map to store the results and a mutex to protect access to the map
+// It uses maps to store the results and mutexes to protect access to the maps
 // It uses a channel to signal when the result is ready
 type Cache struct {
 	client  Client
+	shards  []*shard
+	seed    maphash.Seed
+	repanic bool
+	softTTL time.Duration
+
+	batchWindow time.Duration
+	maxBatch    int
+	batcher     *batcher
+}
+
+// shard is a slice of the cache with its own map, lock and counters
+type shard struct {
 	m       map[string]*data
 	mapLock sync.Mutex
+	stats   counters
+	_       [64]byte // keep neighbouring shards off the same cache line
+}
+
+// Stats is a point-in-time snapshot of cache activity
+type Stats struct {
+	Hits          uint64        // Get calls served from a ready entry
+	Misses        uint64        // Get calls that started a fetch
+	Coalesced     uint64        // Get calls that waited on another caller's in-flight fetch
+	Loads         uint64        // Loads per address, including reloads. With batching, many share one GetMany call
+	LoadErrors    uint64        // Loads that returned an error or panicked
+	TotalLoadTime time.Duration // Time spent loading across all loads, including time queued for a batch
+}
+
+// AverageLoadTime returns the mean latency of a load, as seen by the callers waiting on it
+func (s Stats) AverageLoadTime() time.Duration {
+	if s.Loads == 0 {
+		return 0
+	}
+	return s.TotalLoadTime / time.Duration(s.Loads)
+}
+
+// counters are updated atomically so recording stats never takes the map lock
+// Each shard has its own counters, so shards don't contend on the same cache lines
+type counters struct {
+	hits, misses, coalesced atomic.Uint64
+	loads, loadErrors       atomic.Uint64
+	loadNanos               atomic.Int64
 }
 
 // data is a struct that holds the result of a Get call
 // It uses a channel to signal when the result is ready
 // It uses a string to hold the result of the Get call
 // It uses an error to hold the error of the Get call
+// fetched is set before ready is closed, reloading is guarded by the map lock
 type data struct {
-	body  string
-	err   error
-	ready chan struct{}
+	body      string
+	err       error
+	fetched   time.Time
+	ready     chan struct{}
+	reloading *data // the entry an in-flight reload fills, nil if none
 }
 
 // NewCache creates a new Cache
 // It takes a Client as an argument
 // It returns a pointer to a Cache
-func NewCache(client Client) *Cache {
-	return &Cache{
+func NewCache(client Client, opts ...Option) *Cache {
+	c := &Cache{
 		client: client,
-		m:      make(map[string]*data, 10),
+		shards: make([]*shard, 1),
+		seed:   maphash.MakeSeed(),
+	}
+	for _, opt := range opts {
+		opt(c)
 	}
+	for i := range c.shards {
+		c.shards[i] = &shard{m: make(map[string]*data, 10)}
+	}
+	if bc, ok := client.(BatchClient); ok && c.batchWindow > 0 {
+		c.batcher = &batcher{client: bc, window: c.batchWindow, maxBatch: c.maxBatch}
+	}
+	return c
 }
 
 // Cache Client.Get result
 // This pattern is commonly used to prevent "thundering herd" problems in distributed systems,
 // where multiple concurrent requests for the same resource could overwhelm the system.
 func (c *Cache) Get(address string) (string, error) {
-	c.mapLock.Lock()
-	dataRetrieved, ok := c.m[address]
+	s := c.shard(address)
+	s.mapLock.Lock()
+	dataRetrieved, ok := s.m[address]
 	if !ok {
 		dataRetrieved = &data{
 			body:  "",
@@ -48,14 +168,276 @@ func (c *Cache) Get(address string) (string, error) {
 			ready: make(chan struct{}),
 		}
 
-		c.m[address] = dataRetrieved
-		c.mapLock.Unlock()
+		s.m[address] = dataRetrieved
+		s.mapLock.Unlock()
+
+		s.stats.misses.Add(1)
+		c.fetch(s, address, dataRetrieved)
+	} else {
+		if c.stale(dataRetrieved) {
+			go c.reload(s, address, dataRetrieved, c.startReload(dataRetrieved))
+		}
+		s.mapLock.Unlock()
+
+		select {
+		case <-dataRetrieved.ready:
+			s.stats.hits.Add(1)
+		default:
+			s.stats.coalesced.Add(1)
+			<-dataRetrieved.ready
+		}
+	}
+	return c.result(dataRetrieved)
+}
+
+// Stats returns a snapshot of the cache counters summed over all shards
+// Counters are read independently, so the snapshot may be off by in-progress calls
+func (c *Cache) Stats() Stats {
+	var stats Stats
+	for _, s := range c.shards {
+		stats.Hits += s.stats.hits.Load()
+		stats.Misses += s.stats.misses.Load()
+		stats.Coalesced += s.stats.coalesced.Load()
+		stats.Loads += s.stats.loads.Load()
+		stats.LoadErrors += s.stats.loadErrors.Load()
+		stats.TotalLoadTime += time.Duration(s.stats.loadNanos.Load())
+	}
+	return stats
+}
+
+// Invalidate removes the cached result for address
+// Callers already waiting on an in-flight fetch still receive its result
+func (c *Cache) Invalidate(address string) {
+	s := c.shard(address)
+	s.mapLock.Lock()
+	delete(s.m, address)
+	s.mapLock.Unlock()
+}
+
+// Refresh reloads address and returns the fresh result
+// Concurrent Get calls keep being served the previous value until the reload completes
+// If a fetch or reload for address is already in flight, Refresh waits for it instead
+func (c *Cache) Refresh(address string) (string, error) {
+	s := c.shard(address)
+	s.mapLock.Lock()
+	old, ok := s.m[address]
+	if !ok {
+		s.mapLock.Unlock()
+		return c.Get(address)
+	}
+
+	select {
+	case <-old.ready:
+	default:
+		s.mapLock.Unlock()
+		<-old.ready
+		return c.result(old)
+	}
+
+	if fresh := old.reloading; fresh != nil {
+		s.mapLock.Unlock()
+		<-fresh.ready
+		return c.result(fresh)
+	}
+	fresh := c.startReload(old)
+	s.mapLock.Unlock()
+
+	c.reload(s, address, old, fresh)
+	return c.result(fresh)
+}
+
+// shard returns the shard responsible for address
+func (c *Cache) shard(address string) *shard {
+	if len(c.shards) == 1 {
+		return c.shards[0]
+	}
+	return c.shards[maphash.String(c.seed, address)%uint64(len(c.shards))]
+}
+
+// stale reports whether a ready entry is past the soft TTL and not being reloaded yet
+// Must be called with the map lock held
+func (c *Cache) stale(d *data) bool {
+	if c.softTTL <= 0 || d.reloading != nil {
+		return false
+	}
+	select {
+	case <-d.ready:
+		return time.Since(d.fetched) > c.softTTL
+	default:
+		return false
+	}
+}
+
+// startReload marks old as being reloaded and returns the entry the reload fills
+// Must be called with the map lock held
+func (c *Cache) startReload(old *data) *data {
+	old.reloading = &data{ready: make(chan struct{})}
+	return old.reloading
+}
+
+// reload fetches address into fresh and swaps it in place of old
+// A failed reload never replaces a successful value, so callers keep the stale one
+// and the next Get past the soft TTL retries. Nor does a reload replace an entry
+// that was invalidated or replaced while it was in flight
+func (c *Cache) reload(s *shard, address string, old, fresh *data) {
+	c.fetch(s, address, fresh)
+
+	s.mapLock.Lock()
+	defer s.mapLock.Unlock()
+
+	old.reloading = nil
+	if _, panicked := fresh.err.(*PanicError); panicked || (fresh.err != nil && old.err == nil) {
+		return
+	}
+	if s.m[address] == old {
+		s.m[address] = fresh
+	}
+}
+
+// fetch fills d with the result of a load and closes d.ready
+// A panicked load is removed from the map so the next Get for the address
+// retries instead of caching the panic
+func (c *Cache) fetch(s *shard, address string, d *data) {
+	start := time.Now()
+	d.body, d.err = c.load(address)
+	d.fetched = time.Now()
+
+	s.stats.loads.Add(1)
+	s.stats.loadNanos.Add(int64(d.fetched.Sub(start)))
+	if d.err != nil {
+		s.stats.loadErrors.Add(1)
+	}
+
+	if _, panicked := d.err.(*PanicError); panicked {
+		s.mapLock.Lock()
+		if s.m[address] == d {
+			delete(s.m, address)
+		}
+		s.mapLock.Unlock()
+	}
+	close(d.ready)
+}
+
+// load calls the client for address, through the batcher if batching is enabled
+// A panic in the client is converted to a *PanicError
+func (c *Cache) load(address string) (body string, err error) {
+	if c.batcher != nil {
+		return c.batcher.get(address)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			body, err = "", &PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return c.client.Get(address)
+}
+
+// result returns the value stored in a ready entry, re-panicking if configured to
+func (c *Cache) result(d *data) (string, error) {
+	if pe, ok := d.err.(*PanicError); ok && c.repanic {
+		panic(pe)
+	}
+	return d.body, d.err
+}
+
+// batcher groups concurrent loads into BatchClient.GetMany calls
+// A batch is flushed when it reaches maxBatch addresses or when its window expires
+type batcher struct {
+	client   BatchClient
+	window   time.Duration
+	maxBatch int
+
+	mu      sync.Mutex
+	pending []*call
+	gen     uint64 // incremented on every flush so a stale timer can't flush the next batch
+	timer   *time.Timer
+}
+
+// call is a single address waiting for its batch to complete
+type call struct {
+	address string
+	body    string
+	err     error
+	done    chan struct{}
+}
+
+// get adds address to the pending batch and waits for the batch result
+func (b *batcher) get(address string) (string, error) {
+	cl := &call{address: address, done: make(chan struct{})}
 
-		dataRetrieved.body, dataRetrieved.err = c.client.Get(address)
-		close(dataRetrieved.ready)
+	b.mu.Lock()
+	b.pending = append(b.pending, cl)
+	if b.maxBatch > 0 && len(b.pending) >= b.maxBatch {
+		batch := b.take()
+		b.mu.Unlock()
+		b.run(batch)
 	} else {
-		c.mapLock.Unlock()
-		<-dataRetrieved.ready
+		if len(b.pending) == 1 {
+			gen := b.gen
+			b.timer = time.AfterFunc(b.window, func() { b.flush(gen) })
+		}
+		b.mu.Unlock()
+	}
+
+	<-cl.done
+	return cl.body, cl.err
+}
+
+// flush runs the pending batch if it is still the one the timer was started for
+func (b *batcher) flush(gen uint64) {
+	b.mu.Lock()
+	if b.gen != gen {
+		b.mu.Unlock()
+		return
+	}
+	batch := b.take()
+	b.mu.Unlock()
+
+	b.run(batch)
+}
+
+// take detaches the pending batch
+// Must be called with b.mu held
+func (b *batcher) take() []*call {
+	batch := b.pending
+	b.pending = nil
+	b.gen++
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	return batch
+}
+
+// run performs one GetMany call and fans the results back to every call in the batch
+func (b *batcher) run(batch []*call) {
+	defer func() {
+		if r := recover(); r != nil {
+			pe := &PanicError{Value: r, Stack: debug.Stack()}
+			for _, cl := range batch {
+				cl.body, cl.err = "", pe
+			}
+		}
+		for _, cl := range batch {
+			close(cl.done)
+		}
+	}()
+
+	addresses := make([]string, len(batch))
+	for i, cl := range batch {
+		addresses[i] = cl.address
+	}
+
+	bodies, errs := b.client.GetMany(addresses)
+	for i, cl := range batch {
+		switch {
+		case i < len(errs) && errs[i] != nil:
+			cl.err = errs[i]
+		case i < len(bodies):
+			cl.body = bodies[i]
+		default:
+			cl.err = fmt.Errorf("GetMany returned %d results for %d addresses", len(bodies), len(addresses))
+		}
 	}
-	return dataRetrieved.body, dataRetrieved.err
 }
@@ -2,6 +2,9 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -174,3 +177,431 @@ func TestGet(t *testing.T) {
 	}
 }
 
+type panicClient struct {
+	calls   atomic.Int32
+	release chan struct{}
+}
+
+func (c *panicClient) Get(address string) (string, error) {
+	if c.calls.Add(1) == 1 {
+		<-c.release
+		panic("boom")
+	}
+	return "recovered", nil
+}
+
+func TestGetPanic(t *testing.T) {
+	client := &panicClient{release: make(chan struct{})}
+	cache := NewCache(client)
+
+	const waiters = 5
+	errs := make(chan error, waiters)
+	var wg sync.WaitGroup
+	for range waiters {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := cache.Get("example.com")
+			errs <- err
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(client.release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		var pe *PanicError
+		if !errors.As(err, &pe) {
+			t.Fatalf("Expected *PanicError, got: %v", err)
+		}
+		if pe.Value != "boom" {
+			t.Errorf("Wrong panic value. Expected: boom, got: %v", pe.Value)
+		}
+	}
+
+	resp, err := cache.Get("example.com")
+	if err != nil {
+		t.Fatalf("Unexpected error after panic: %v", err)
+	}
+	if resp != "recovered" {
+		t.Errorf("Wrong response. Expected: recovered, got: %s", resp)
+	}
+}
+
+func TestGetRepanic(t *testing.T) {
+	client := &panicClient{release: make(chan struct{})}
+	close(client.release)
+	cache := NewCache(client, WithRepanic())
+
+	func() {
+		defer func() {
+			r := recover()
+			if _, ok := r.(*PanicError); !ok {
+				t.Errorf("Expected panic with *PanicError, got: %v", r)
+			}
+		}()
+		cache.Get("example.com")
+	}()
+
+	resp, err := cache.Get("example.com")
+	if err != nil || resp != "recovered" {
+		t.Errorf("Expected retry after panic, got: %s, %v", resp, err)
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	client := newMockClient(map[string][]response{
+		"example.com": {
+			{body: "first response"},
+			{body: "second response"},
+		},
+	})
+	cache := NewCache(client)
+
+	if resp, _ := cache.Get("example.com"); resp != "first response" {
+		t.Fatalf("Wrong response. Expected: first response, got: %s", resp)
+	}
+
+	cache.Invalidate("example.com")
+	cache.Invalidate("nonexistent.com")
+
+	if resp, _ := cache.Get("example.com"); resp != "second response" {
+		t.Errorf("Wrong response after Invalidate. Expected: second response, got: %s", resp)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	client := newMockClient(map[string][]response{
+		"example.com": {
+			{body: "first response"},
+			{body: "second response"},
+		},
+		"error.com": {
+			{body: "ok"},
+			{err: ErrExpected},
+		},
+	})
+	cache := NewCache(client)
+
+	if resp, err := cache.Refresh("example.com"); resp != "first response" || err != nil {
+		t.Fatalf("Refresh of missing key should fetch it, got: %s, %v", resp, err)
+	}
+	if resp, err := cache.Refresh("example.com"); resp != "second response" || err != nil {
+		t.Fatalf("Wrong response from Refresh, got: %s, %v", resp, err)
+	}
+	if resp, _ := cache.Get("example.com"); resp != "second response" {
+		t.Errorf("Get should return refreshed value, got: %s", resp)
+	}
+
+	cache.Get("error.com")
+	if _, err := cache.Refresh("error.com"); err != ErrExpected {
+		t.Errorf("Refresh should return the reload error, got: %v", err)
+	}
+	if resp, err := cache.Get("error.com"); resp != "ok" || err != nil {
+		t.Errorf("Failed reload should keep the stale value, got: %s, %v", resp, err)
+	}
+}
+
+func TestRefreshConcurrent(t *testing.T) {
+	client := newMockClient(map[string][]response{
+		"example.com": {
+			{body: "first response"},
+			{body: "second response", delay: 50 * time.Millisecond},
+		},
+	})
+	cache := NewCache(client)
+	cache.Get("example.com")
+
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if resp, err := cache.Refresh("example.com"); resp != "second response" || err != nil {
+				t.Errorf("Concurrent Refresh should share one reload, got: %s, %v", resp, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if loads := cache.Stats().Loads; loads != 2 {
+		t.Errorf("Expected 2 loads, got %d", loads)
+	}
+}
+
+func TestInvalidateDuringReload(t *testing.T) {
+	client := newMockClient(map[string][]response{
+		"example.com": {
+			{body: "first response"},
+			{body: "second response", delay: 50 * time.Millisecond},
+			{body: "third response"},
+		},
+	})
+	cache := NewCache(client)
+	cache.Get("example.com")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if resp, _ := cache.Refresh("example.com"); resp != "second response" {
+			t.Errorf("Refresh should return its own reload, got: %s", resp)
+		}
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cache.Invalidate("example.com")
+	<-done
+
+	if resp, _ := cache.Get("example.com"); resp != "third response" {
+		t.Errorf("Reload must not undo Invalidate. Expected: third response, got: %s", resp)
+	}
+}
+
+func TestRefreshAhead(t *testing.T) {
+	client := newMockClient(map[string][]response{
+		"example.com": {
+			{body: "first response"},
+			{body: "second response", delay: 100 * time.Millisecond},
+		},
+	})
+	cache := NewCache(client, WithRefreshAhead(50*time.Millisecond))
+
+	cache.Get("example.com")
+	time.Sleep(60 * time.Millisecond)
+
+	start := time.Now()
+	for range 3 {
+		if resp, _ := cache.Get("example.com"); resp != "first response" {
+			t.Errorf("Stale value should be served during reload, got: %s", resp)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("Get blocked on background reload for %v", elapsed)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if resp, _ := cache.Get("example.com"); resp != "second response" {
+		t.Errorf("Wrong response after background reload. Expected: second response, got: %s", resp)
+	}
+}
+
+func TestStats(t *testing.T) {
+	client := newMockClient(map[string][]response{
+		"example.com": {
+			{body: "response1", delay: 100 * time.Millisecond},
+		},
+		"error.com": {
+			{err: ErrExpected},
+		},
+	})
+	cache := NewCache(client)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		cache.Get("example.com")
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cache.Get("example.com")
+		}()
+	}
+	wg.Wait()
+
+	cache.Get("example.com")
+	cache.Get("error.com")
+
+	stats := cache.Stats()
+	expected := Stats{Hits: 1, Misses: 2, Coalesced: 3, Loads: 2, LoadErrors: 1}
+	stats.TotalLoadTime, expected.TotalLoadTime = 0, 0
+	if stats != expected {
+		t.Errorf("Wrong stats. Expected: %+v, got: %+v", expected, stats)
+	}
+	if avg := cache.Stats().AverageLoadTime(); avg < 50*time.Millisecond {
+		t.Errorf("Average load time too low: %v", avg)
+	}
+}
+
+type echoClient struct{}
+
+func (echoClient) Get(address string) (string, error) {
+	return "resp:" + address, nil
+}
+
+func TestShardedGet(t *testing.T) {
+	cache := NewCache(echoClient{}, WithShards(8))
+
+	var wg sync.WaitGroup
+	for i := range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 100 {
+				address := fmt.Sprintf("example-%d.com", (i+j)%32)
+				resp, err := cache.Get(address)
+				if err != nil || resp != "resp:"+address {
+					t.Errorf("Wrong response for %s: %s, %v", address, resp, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	stats := cache.Stats()
+	if stats.Misses != 32 || stats.Loads != 32 {
+		t.Errorf("Expected 32 misses and loads, got: %+v", stats)
+	}
+	if total := stats.Hits + stats.Misses + stats.Coalesced; total != 1600 {
+		t.Errorf("Expected 1600 Get calls in stats, got: %d", total)
+	}
+
+	cache.Invalidate("example-0.com")
+	if resp, _ := cache.Refresh("example-1.com"); resp != "resp:example-1.com" {
+		t.Errorf("Wrong response from Refresh: %s", resp)
+	}
+	if cache.Stats().Loads != 33 {
+		t.Errorf("Expected 33 loads after Refresh, got: %d", cache.Stats().Loads)
+	}
+}
+
+func BenchmarkGetParallel(b *testing.B) {
+	addresses := make([]string, 1024)
+	for i := range addresses {
+		addresses[i] = fmt.Sprintf("example-%d.com", i)
+	}
+
+	for _, shards := range []int{1, 4, 16, 64} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			cache := NewCache(echoClient{}, WithShards(shards))
+			for _, address := range addresses {
+				cache.Get(address)
+			}
+
+			var offset atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				// Start each goroutine at a different address so they don't move in lockstep
+				i := int(offset.Add(97))
+				for pb.Next() {
+					cache.Get(addresses[i%len(addresses)])
+					i++
+				}
+			})
+		})
+	}
+}
+
+type batchClient struct {
+	echoClient
+	mu      sync.Mutex
+	batches [][]string
+	panics  bool
+}
+
+func (c *batchClient) GetMany(addresses []string) ([]string, []error) {
+	c.mu.Lock()
+	c.batches = append(c.batches, addresses)
+	c.mu.Unlock()
+
+	if c.panics {
+		panic("bulk boom")
+	}
+
+	bodies, errs := make([]string, len(addresses)), make([]error, len(addresses))
+	for i, address := range addresses {
+		if address == "error.com" {
+			errs[i] = ErrExpected
+			continue
+		}
+		bodies[i], _ = c.Get(address)
+	}
+	return bodies, errs
+}
+
+func TestBatching(t *testing.T) {
+	tests := []struct {
+		name      string
+		window    time.Duration
+		maxBatch  int
+		panics    bool
+		addresses []string
+		batches   int
+	}{
+		{
+			name:      "Window collects misses",
+			window:    50 * time.Millisecond,
+			addresses: []string{"a.com", "b.com", "c.com", "d.com", "error.com"},
+			batches:   1,
+		},
+		{
+			name:      "Max batch size",
+			window:    time.Second,
+			maxBatch:  2,
+			addresses: []string{"a.com", "b.com", "c.com", "d.com"},
+			batches:   2,
+		},
+		{
+			name:      "Panic in GetMany",
+			window:    50 * time.Millisecond,
+			panics:    true,
+			addresses: []string{"a.com", "b.com"},
+			batches:   1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &batchClient{panics: tt.panics}
+			cache := NewCache(client, WithBatching(tt.window, tt.maxBatch))
+
+			var wg sync.WaitGroup
+			for _, address := range tt.addresses {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					resp, err := cache.Get(address)
+
+					var pe *PanicError
+					switch {
+					case tt.panics:
+						if !errors.As(err, &pe) {
+							t.Errorf("Expected *PanicError for %s, got: %v", address, err)
+						}
+					case address == "error.com":
+						if err != ErrExpected {
+							t.Errorf("Unexpected error for %s: %v", address, err)
+						}
+					case resp != "resp:"+address || err != nil:
+						t.Errorf("Wrong response for %s: %s, %v", address, resp, err)
+					}
+				}()
+			}
+			wg.Wait()
+
+			if len(client.batches) != tt.batches {
+				t.Errorf("Expected %d GetMany calls, got: %v", tt.batches, client.batches)
+			}
+			if stats := cache.Stats(); stats.Loads != uint64(len(tt.addresses)) {
+				t.Errorf("Expected %d loads, got: %d", len(tt.addresses), stats.Loads)
+			}
+		})
+	}
+}
+
+func TestBatchingWithoutBatchClient(t *testing.T) {
+	cache := NewCache(echoClient{}, WithBatching(time.Second, 10))
+
+	start := time.Now()
+	if resp, err := cache.Get("a.com"); resp != "resp:a.com" || err != nil {
+		t.Errorf("Wrong response: %s, %v", resp, err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Plain client should not wait for a batch window, took %v", elapsed)
+	}
+}
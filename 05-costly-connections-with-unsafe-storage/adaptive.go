@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// AdaptiveLimit configures an AIMD concurrency limit, in the style of Netflix concurrency-limits
+// The limit grows by one for every request that completes without error while latency
+// stays close to the lowest recent latency, and is multiplied by BackoffRatio on an error
+// or a latency spike. It always stays between 1 and maxConn.
+// Latency is the time spent in Connection.Send, without connecting or retry backoff
+type AdaptiveLimit struct {
+	// Initial is the starting limit, defaults to 1
+	Initial int
+	// BackoffRatio is applied to the limit on an error or a latency spike, defaults to 0.9
+	BackoffRatio float64
+	// Tolerance is how many times the lowest recent latency a request may take
+	// before it counts as a spike, defaults to 2
+	Tolerance float64
+	// Window is how many successful requests the lowest latency is kept for
+	// before it is measured anew, so the limit recovers after a lasting slowdown. Defaults to 100
+	Window int
+}
+
+// WithAdaptiveLimit adjusts how many requests are sent concurrently according to cfg,
+// instead of always using maxConn connections
+func WithAdaptiveLimit(cfg AdaptiveLimit) Option {
+	return func(c *config) {
+		c.adaptive = &cfg
+	}
+}
+
+// aimdLimiter gates requests by an additive-increase/multiplicative-decrease limit
+type aimdLimiter struct {
+	cfg AdaptiveLimit
+	max int
+
+	mu        sync.Mutex
+	limit     float64
+	inflight  int
+	minRTT    time.Duration // lowest latency of the last complete window
+	windowMin time.Duration // lowest latency of the current window
+	samples   int           // latencies recorded in the current window
+	changed   chan struct{} // closed and replaced when a slot frees up or the limit grows
+}
+
+func newAIMDLimiter(cfg AdaptiveLimit, maxLimit int) *aimdLimiter {
+	if cfg.BackoffRatio <= 0 || cfg.BackoffRatio >= 1 {
+		cfg.BackoffRatio = 0.9
+	}
+	if cfg.Tolerance <= 1 {
+		cfg.Tolerance = 2
+	}
+	if cfg.Window < 1 {
+		cfg.Window = 100
+	}
+	maxLimit = max(maxLimit, 1)
+	return &aimdLimiter{
+		cfg:     cfg,
+		max:     maxLimit,
+		limit:   float64(min(max(cfg.Initial, 1), maxLimit)),
+		changed: make(chan struct{}),
+	}
+}
+
+// acquire blocks until fewer requests than the current limit are in flight
+func (l *aimdLimiter) acquire(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		if l.inflight < int(l.limit) {
+			l.inflight++
+			l.mu.Unlock()
+			return nil
+		}
+		changed := l.changed
+		l.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// release records the latency and error of a request started with acquire and adjusts the limit
+// The latency of a failed request is not recorded, failures are often unusually fast
+func (l *aimdLimiter) release(latency time.Duration, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	inflight := l.inflight
+	l.inflight--
+
+	var spike bool
+	if err == nil {
+		spike = l.record(latency)
+	}
+	switch {
+	case err != nil || spike:
+		l.limit = max(l.limit*l.cfg.BackoffRatio, 1)
+	case inflight*2 >= int(l.limit):
+		// Only grow while the current limit is actually being used
+		l.limit = min(l.limit+1, float64(l.max))
+	}
+
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// record adds a latency sample to the current window and reports whether it is a spike
+// Samples are compared to the lowest latency of the last and the current window,
+// so a lasting slowdown becomes the new baseline once a full window passed
+// Must be called with l.mu held
+func (l *aimdLimiter) record(latency time.Duration) bool {
+	if l.samples == 0 || latency < l.windowMin {
+		l.windowMin = latency
+	}
+	l.samples++
+
+	baseline := l.windowMin
+	if l.minRTT > 0 {
+		baseline = min(baseline, l.minRTT)
+	}
+	if l.samples >= l.cfg.Window {
+		l.minRTT, l.samples = l.windowMin, 0
+	}
+	return float64(latency) > l.cfg.Tolerance*float64(baseline)
+}
+
+// current returns the limit rounded down
+func (l *aimdLimiter) current() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return int(l.limit)
+}
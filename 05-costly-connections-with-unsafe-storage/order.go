@@ -0,0 +1,28 @@
+package main
+
+// reorderBuffer holds outcomes that completed ahead of earlier requests
+// and releases them in request order
+type reorderBuffer struct {
+	next    int
+	pending map[int]outcome
+}
+
+func newReorderBuffer() *reorderBuffer {
+	return &reorderBuffer{pending: make(map[int]outcome)}
+}
+
+// push adds o and returns every outcome that is now ready to be emitted, in request order
+func (b *reorderBuffer) push(o outcome) []outcome {
+	b.pending[o.index] = o
+
+	var ready []outcome
+	for {
+		next, ok := b.pending[b.next]
+		if !ok {
+			return ready
+		}
+		delete(b.pending, b.next)
+		ready = append(ready, next)
+		b.next++
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrPoolClosed is returned by Acquire after Close
+var ErrPoolClosed = errors.New("pool is closed")
+
+// ConnectError is returned by Acquire when a new connection could not be created
+type ConnectError struct {
+	Err error
+}
+
+func (e *ConnectError) Error() string {
+	return "create connection: " + e.Err.Error()
+}
+
+func (e *ConnectError) Unwrap() error {
+	return e.Err
+}
+
+// PoolConfig configures a Pool
+type PoolConfig struct {
+	// MaxSize is the maximum number of open connections, at least 1
+	MaxSize int
+	// IdleTimeout disconnects connections unused for longer than this, 0 means never
+	IdleTimeout time.Duration
+	// MaxLifetime disconnects connections older than this, 0 means never
+	MaxLifetime time.Duration
+	// HealthCheck is called on an idle connection before it is handed out
+	// Connections that fail it are disconnected and replaced
+	HealthCheck func(Connection) error
+	// ConnectRetryInterval is how often Acquire retries creating a connection after
+	// NewConnection failed while other connections are open, defaults to 100ms
+	ConnectRetryInterval time.Duration
+}
+
+const defaultConnectRetryInterval = 100 * time.Millisecond
+
+// PoolStats is a snapshot of the pool state
+type PoolStats struct {
+	Open   int // connections currently connected
+	Idle   int // connections waiting in the pool
+	InUse  int // connections handed out by Acquire
+	Opened int // connections created over the lifetime of the pool
+}
+
+// Pool is a long-lived pool of connections created by a ConnectionCreator
+// Connections are connected lazily on Acquire and reused after Release
+// Connections must be comparable, which holds for pointer implementations
+type Pool struct {
+	creator ConnectionCreator
+	cfg     PoolConfig
+
+	// sem holds a token for every connection in use or being created
+	// so open connections never exceed MaxSize
+	sem    chan struct{}
+	done   chan struct{}
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	idle     []*pooledConn // most recently used last
+	inUse    map[Connection]*pooledConn
+	creating int
+	released chan struct{} // closed and replaced whenever a connection becomes idle
+	opened   int
+	closed   bool
+}
+
+// pooledConn is a connection with the times the pool needs to expire it
+type pooledConn struct {
+	conn     Connection
+	created  time.Time
+	lastUsed time.Time
+}
+
+// NewPool creates a Pool
+// A background goroutine disconnects expired idle connections until Close is called
+func NewPool(creator ConnectionCreator, cfg PoolConfig) *Pool {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Pool{
+		creator:  creator,
+		cfg:      cfg,
+		sem:      make(chan struct{}, max(cfg.MaxSize, 1)),
+		done:     make(chan struct{}),
+		cancel:   cancel,
+		inUse:    make(map[Connection]*pooledConn),
+		released: make(chan struct{}),
+	}
+
+	if interval := p.cleanupInterval(); interval > 0 {
+		go p.cleanupExpired(ctx, interval)
+	}
+
+	return p
+}
+
+// Acquire returns a connected connection, reusing an idle one if possible
+// It blocks while MaxSize connections are in use, until one is released or ctx is done
+// If a new connection can't be created, Acquire waits for one of the open connections
+// and keeps retrying in the background. It fails with a *ConnectError only if no
+// connection is open at all
+func (p *Pool) Acquire(ctx context.Context) (Connection, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	select {
+	case p.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-p.done:
+		return nil, ErrPoolClosed
+	}
+
+	var retry *time.Timer
+	for create := true; ; {
+		conn, wait, err := p.take(create)
+		if conn != nil || err != nil {
+			if retry != nil {
+				retry.Stop()
+			}
+			if err != nil {
+				<-p.sem
+			}
+			return conn, err
+		}
+
+		// Creating failed but other connections are open: wait for one of them
+		// to be released, and try to create the missing connection again meanwhile
+		if create {
+			if retry == nil {
+				retry = time.NewTimer(p.retryInterval())
+			} else {
+				retry.Reset(p.retryInterval())
+			}
+		}
+		select {
+		case <-wait:
+			create = false
+		case <-retry.C:
+			create = true
+		case <-ctx.Done():
+			retry.Stop()
+			<-p.sem
+			return nil, ctx.Err()
+		case <-p.done:
+			retry.Stop()
+			<-p.sem
+			return nil, ErrPoolClosed
+		}
+	}
+}
+
+// take returns an idle connection, or a new one if create is set and none is idle
+// Must be called holding a semaphore token. If creating fails while other connections
+// are open, it returns a channel closed on the next Release instead of an error
+func (p *Pool) take(create bool) (Connection, <-chan struct{}, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, nil, ErrPoolClosed
+		}
+
+		n := len(p.idle)
+		if n == 0 {
+			if !create {
+				wait := p.released
+				p.mu.Unlock()
+				return nil, wait, nil
+			}
+			p.creating++
+			p.mu.Unlock()
+			break
+		}
+		pc := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+
+		if p.expired(pc, time.Now()) || !p.healthy(pc) {
+			pc.conn.Disconnect()
+			continue
+		}
+
+		p.mu.Lock()
+		p.inUse[pc.conn] = pc
+		p.mu.Unlock()
+		return pc.conn, nil, nil
+	}
+
+	conn, err := p.creator.NewConnection()
+	if err != nil {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		p.creating--
+		if len(p.idle)+len(p.inUse)+p.creating == 0 {
+			return nil, nil, &ConnectError{Err: err}
+		}
+		return nil, p.released, nil
+	}
+	conn.Connect()
+
+	now := time.Now()
+	p.mu.Lock()
+	p.creating--
+	p.inUse[conn] = &pooledConn{conn: conn, created: now, lastUsed: now}
+	p.opened++
+	p.mu.Unlock()
+	return conn, nil, nil
+}
+
+// retryInterval returns how long Acquire waits before trying to create a connection again
+func (p *Pool) retryInterval() time.Duration {
+	if p.cfg.ConnectRetryInterval > 0 {
+		return p.cfg.ConnectRetryInterval
+	}
+	return defaultConnectRetryInterval
+}
+
+// Release returns a connection obtained from Acquire to the pool
+func (p *Pool) Release(conn Connection) {
+	p.mu.Lock()
+	pc, ok := p.inUse[conn]
+	if !ok {
+		p.mu.Unlock()
+		return
+	}
+	delete(p.inUse, conn)
+
+	now := time.Now()
+	keep := !p.closed && !p.expired(pc, now)
+	if keep {
+		pc.lastUsed = now
+		p.idle = append(p.idle, pc)
+		close(p.released)
+		p.released = make(chan struct{})
+	}
+	p.mu.Unlock()
+
+	if !keep {
+		conn.Disconnect()
+	}
+	<-p.sem
+}
+
+// Discard disconnects a connection obtained from Acquire instead of reusing it
+// Use it for connections that are known to be broken
+func (p *Pool) Discard(conn Connection) {
+	p.mu.Lock()
+	_, ok := p.inUse[conn]
+	delete(p.inUse, conn)
+	p.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	conn.Disconnect()
+	<-p.sem
+}
+
+// Stats returns a snapshot of the pool state
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return PoolStats{
+		Open:   len(p.idle) + len(p.inUse),
+		Idle:   len(p.idle),
+		InUse:  len(p.inUse),
+		Opened: p.opened,
+	}
+}
+
+// Close disconnects idle connections and waits until every connection in use
+// has been released, disconnecting it as well. Acquire fails with ErrPoolClosed afterwards
+func (p *Pool) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+
+	p.cancel()
+	close(p.done)
+	for _, pc := range idle {
+		pc.conn.Disconnect()
+	}
+
+	// Every token back in the semaphore means no connection is in use anymore
+	for range cap(p.sem) {
+		p.sem <- struct{}{}
+	}
+}
+
+// expired reports whether pc is past its idle timeout or maximum lifetime
+func (p *Pool) expired(pc *pooledConn, now time.Time) bool {
+	if p.cfg.MaxLifetime > 0 && now.Sub(pc.created) > p.cfg.MaxLifetime {
+		return true
+	}
+	return p.cfg.IdleTimeout > 0 && now.Sub(pc.lastUsed) > p.cfg.IdleTimeout
+}
+
+// healthy runs the configured health check
+func (p *Pool) healthy(pc *pooledConn) bool {
+	return p.cfg.HealthCheck == nil || p.cfg.HealthCheck(pc.conn) == nil
+}
+
+// cleanupInterval returns how often expired idle connections are looked for, 0 to never
+func (p *Pool) cleanupInterval() time.Duration {
+	interval := p.cfg.IdleTimeout
+	if p.cfg.MaxLifetime > 0 && (interval == 0 || p.cfg.MaxLifetime < interval) {
+		interval = p.cfg.MaxLifetime
+	}
+	return interval / 2
+}
+
+func (p *Pool) cleanupExpired(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now()
+			var expired []*pooledConn
+
+			p.mu.Lock()
+			idle := p.idle[:0]
+			for _, pc := range p.idle {
+				if p.expired(pc, now) {
+					expired = append(expired, pc)
+				} else {
+					idle = append(idle, pc)
+				}
+			}
+			p.idle = idle
+			p.mu.Unlock()
+
+			for _, pc := range expired {
+				pc.conn.Disconnect()
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+// ErrBrokenConnection should be wrapped by Send errors after which the connection can't be reused
+var ErrBrokenConnection = errors.New("broken connection")
+
+// RetryPolicy controls how failed Send calls are retried
+type RetryPolicy struct {
+	// MaxAttempts is the total number of Send calls per request, <= 1 disables retries
+	MaxAttempts int
+	// BaseDelay is the wait before the first retry, doubled for every following retry
+	BaseDelay time.Duration
+	// MaxDelay caps a single wait, 0 means no cap
+	MaxDelay time.Duration
+	// Jitter is the fraction of each wait that is randomized, from 0 to 1
+	Jitter float64
+	// IsFatal reports whether err broke the connection
+	// Defaults to errors.Is(err, ErrBrokenConnection)
+	IsFatal func(err error) bool
+}
+
+// fatal reports whether err means the connection must be replaced
+func (p RetryPolicy) fatal(err error) bool {
+	if p.IsFatal != nil {
+		return p.IsFatal(err)
+	}
+	return errors.Is(err, ErrBrokenConnection)
+}
+
+// backoff returns the wait before retry number n, starting at 1
+// Uses exponential backoff with jitter so retries from many workers don't line up
+func (p RetryPolicy) backoff(n int) time.Duration {
+	delay := time.Duration(math.MaxInt64)
+	if shift := n - 1; p.BaseDelay <= 0 || (shift < 63 && p.BaseDelay <= math.MaxInt64>>shift) {
+		// Doubling doesn't overflow yet
+		delay = max(p.BaseDelay, 0) << shift
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if p.Jitter > 0 && delay > 0 {
+		jitter := min(p.Jitter, 1)
+		delay -= time.Duration(rand.Float64() * jitter * float64(delay))
+	}
+	return delay
+}
+
+// sender sends requests on connections from a pool
+type sender struct {
+	pool   *Pool
+	policy RetryPolicy
+}
+
+// send sends req, retrying according to the policy, and returns how long the last Send took
+// Acquiring a connection and waiting between attempts are not part of that latency.
+// A connection broken by a fatal error is discarded, and the next attempt
+// acquires a connection in its place, so the pool never grows past its size.
+// Acquire errors are returned as they are, without further attempts.
+func (s *sender) send(ctx context.Context, req string) (resp string, latency time.Duration, err error) {
+	for attempt := 1; ; attempt++ {
+		conn, err := s.pool.Acquire(ctx)
+		if err != nil {
+			return "", latency, err
+		}
+
+		start := time.Now()
+		resp, err := conn.Send(req)
+		latency = time.Since(start)
+		if err == nil {
+			s.pool.Release(conn)
+			return resp, latency, nil
+		}
+		slog.Error("Failed to send request", "error", err, "attempt", attempt)
+
+		if s.policy.fatal(err) {
+			s.pool.Discard(conn)
+		} else {
+			s.pool.Release(conn)
+		}
+
+		if attempt >= s.policy.MaxAttempts {
+			return "", latency, err
+		}
+
+		timer := time.NewTimer(s.policy.backoff(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return "", latency, err
+		}
+	}
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log/slog"
 	"sync"
+	"time"
 )
 
 type Connection interface {
@@ -29,48 +33,296 @@ type Saver interface {
 	Save(data string)
 }
 
+// BatchSaver is a Saver that can also save many responses in one call
+// SendAndSave detects it and saves responses in batches
+type BatchSaver interface {
+	Saver
+
+	// Saves a batch of data to unsafe storage
+	// WILL CORRUPT DATA on concurrent save, including concurrent Save calls
+	SaveBatch(data []string)
+}
+
+// Default batching used when the saver is a BatchSaver
+const (
+	defaultBatchSize     = 64
+	defaultBatchInterval = 50 * time.Millisecond
+)
+
+// ErrInvalidMaxConn is reported for every request when maxConn is less than 1
+var ErrInvalidMaxConn = errors.New("maxConn must be at least 1")
+
+// Result is the outcome of a single request
+type Result struct {
+	// Index is the position of the request in the input
+	Index    int
+	Request  string
+	Response string
+	Err      error
+}
+
+// Report describes what happened to the requests passed to SendAndSave
+type Report struct {
+	// Results has one entry per request, in request order
+	// It is nil for SendAndSaveStream, use WithResultHandler to observe results instead
+	Results []Result
+	// Succeeded and Errored count the requests by outcome
+	Succeeded, Errored int
+	// Connections is how many connections were actually established
+	Connections int
+	// Err joins every connection and request error, nil if all requests were saved
+	// For SendAndSaveStream it only wraps the first error, to keep memory constant
+	Err error
+}
+
+// Failed returns the requests that were not sent successfully, in request order
+func (r *Report) Failed() []string {
+	var failed []string
+	for _, res := range r.Results {
+		if res.Err != nil {
+			failed = append(failed, res.Request)
+		}
+	}
+	return failed
+}
+
+// job is a request together with its position in the input
+type job struct {
+	index int
+	req   string
+}
+
+// outcome is the result of sending a job
+type outcome struct {
+	index int
+	req   string
+	resp  string
+	err   error
+}
+
+// Option configures SendAndSaveContext and SendAndSaveStream
+type Option func(*config)
+
+type config struct {
+	retry         RetryPolicy
+	ordered       int
+	batchSize     int
+	batchInterval time.Duration
+	onResult      func(Result)
+	adaptive      *AdaptiveLimit
+}
+
+// WithRetry retries failed Send calls according to policy
+// Broken connections are discarded regardless of the number of attempts
+func WithRetry(policy RetryPolicy) Option {
+	return func(c *config) {
+		c.retry = policy
+	}
+}
+
+// WithOrder saves responses in request order instead of completion order
+// At most bufferSize requests are dispatched ahead of the oldest unsaved one,
+// which bounds how many responses wait in memory behind a slow request
+func WithOrder(bufferSize int) Option {
+	return func(c *config) {
+		c.ordered = max(bufferSize, 1)
+	}
+}
+
+// WithBatchSave sets when batches are flushed to a BatchSaver: once they hold size
+// responses, or interval after the first response was added. It has no effect on a plain Saver
+func WithBatchSave(size int, interval time.Duration) Option {
+	return func(c *config) {
+		c.batchSize, c.batchInterval = size, interval
+	}
+}
+
+// WithResultHandler calls fn with the result of every request that was sent
+// fn is called from a single goroutine, in the order responses are saved
+func WithResultHandler(fn func(Result)) Option {
+	return func(c *config) {
+		c.onResult = fn
+	}
+}
+
+func newConfig(opts []Option) config {
+	cfg := config{batchSize: defaultBatchSize, batchInterval: defaultBatchInterval}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
 // SendAndSave should send all requests concurrently using at most `maxConn` simultaneous connections.
 // Responses must be saved using Saver.Save.
 // Be careful: Saver.Save is not safe for concurrent use.
-func SendAndSave(creator ConnectionCreator, saver Saver, requests []string, maxConn int) {
-	var wg sync.WaitGroup
-	wg.Add(maxConn)
-	reqCh := make(chan string, len(requests))
-	saveCh := make(chan string, len(requests))
+// The returned report has the outcome of every request, so callers can retry only the failures.
+func SendAndSave(creator ConnectionCreator, saver Saver, requests []string, maxConn int) *Report {
+	return SendAndSaveContext(context.Background(), creator, saver, requests, maxConn)
+}
 
-	//Populate request channel
-	for _, req := range requests {
+// SendAndSaveContext is SendAndSave with cancellation and options.
+// It proceeds with as many connections as can be opened, up to maxConn, and keeps
+// trying to open the missing ones in the background. It only gives up if none can be opened.
+// Once ctx is done no new requests are dispatched, but requests already being sent
+// are finished and their responses saved. Every connection is disconnected before returning.
+// Requests that were never sent are reported with ctx.Err().
+func SendAndSaveContext(ctx context.Context, creator ConnectionCreator, saver Saver, requests []string, maxConn int, opts ...Option) *Report {
+	cfg := newConfig(opts)
+
+	report := &Report{Results: make([]Result, len(requests))}
+	reqCh := make(chan string, len(requests))
+	for i, req := range requests {
+		report.Results[i] = Result{Index: i, Request: req}
 		reqCh <- req
 	}
 	close(reqCh)
 
-	//Connection pool to reuse connections
-	connPool := make(chan Connection, maxConn)
-	for range maxConn {
-		conn, err := creator.NewConnection()
-		if err != nil {
-			slog.Error("Failed to create connection", "error", err)
-			return
+	onResult := cfg.onResult
+	cfg.onResult = func(res Result) {
+		report.Results[res.Index] = res
+		if onResult != nil {
+			onResult(res)
+		}
+	}
+
+	run := sendAndSave(ctx, creator, saver, reqCh, maxConn, cfg)
+
+	// Requests are dispatched in order, so the unsent ones are the tail
+	unsentErr := ctx.Err()
+	if run.abortErr != nil {
+		unsentErr = run.abortErr
+	}
+	for i := run.dispatched; i < len(requests); i++ {
+		report.Results[i].Err = unsentErr
+	}
+
+	var errs []error
+	for _, res := range report.Results {
+		if res.Err != nil {
+			report.Errored++
+			errs = append(errs, fmt.Errorf("request %q: %w", res.Request, res.Err))
+		} else {
+			report.Succeeded++
+		}
+	}
+	report.Connections = run.connections
+	report.Err = errors.Join(errs...)
+	return report
+}
+
+// SendAndSaveStream is SendAndSaveContext for a stream of requests read until it is closed.
+// Memory stays constant regardless of the number of requests: the stream is only read
+// while a connection is free, and connections wait while the saver is busy.
+// The report only has counts, results can be observed with WithResultHandler.
+// Requests left in the stream on cancellation are not read and not counted.
+func SendAndSaveStream(ctx context.Context, creator ConnectionCreator, saver Saver, requests <-chan string, maxConn int, opts ...Option) *Report {
+	cfg := newConfig(opts)
+
+	report := &Report{}
+	var firstErr error
+	onResult := cfg.onResult
+	cfg.onResult = func(res Result) {
+		if res.Err != nil {
+			report.Errored++
+			if firstErr == nil {
+				firstErr = fmt.Errorf("request %q: %w", res.Request, res.Err)
+			}
+		} else {
+			report.Succeeded++
+		}
+		if onResult != nil {
+			onResult(res)
 		}
-		conn.Connect()
-		connPool <- conn
 	}
 
+	run := sendAndSave(ctx, creator, saver, requests, maxConn, cfg)
+
+	if firstErr == nil {
+		firstErr = run.abortErr
+	}
+	if firstErr != nil {
+		report.Err = fmt.Errorf("%d of %d requests failed, first error: %w", report.Errored, report.Succeeded+report.Errored, firstErr)
+	}
+	report.Connections = run.connections
+	return report
+}
+
+// runStats is what sendAndSave tells its callers about a run
+type runStats struct {
+	// dispatched is how many requests were handed to workers, always a prefix of the input
+	dispatched int
+	// connections is how many connections were established
+	connections int
+	// abortErr is set when no connection at all could be established, which stops dispatching,
+	// or when maxConn is invalid and nothing was dispatched
+	abortErr error
+}
+
+// dispatchResult is what the dispatcher reports when it stops
+type dispatchResult struct {
+	count int
+	held  *job // a request read from the input that could not be dispatched
+}
+
+// sendAndSave sends requests read from reqCh and saves the responses,
+// reporting every dispatched request to cfg.onResult
+func sendAndSave(ctx context.Context, creator ConnectionCreator, saver Saver, requests <-chan string, maxConn int, cfg config) runStats {
+	var run runStats
+	if maxConn < 1 {
+		// No worker would ever read a request, so dispatching would block forever
+		run.abortErr = ErrInvalidMaxConn
+		return run
+	}
+
+	//Connections are created lazily by the pool and shared by the workers
+	pool := NewPool(creator, PoolConfig{MaxSize: maxConn})
+	defer pool.Close()
+	s := &sender{pool: pool, policy: cfg.retry}
+	var limiter *aimdLimiter
+	if cfg.adaptive != nil {
+		limiter = newAIMDLimiter(*cfg.adaptive, maxConn)
+	}
+
+	// Channels are bounded by maxConn, so a slow saver blocks workers and workers block reading requests
+	reqCh := make(chan job)
+	saveCh := make(chan outcome, maxConn)
+	stopped := make(chan struct{})
+	dispatched := make(chan dispatchResult, 1)
+	var window chan struct{} // a token for every dispatched request not yet saved in ordered mode
+	if cfg.ordered > 0 {
+		window = make(chan struct{}, cfg.ordered)
+	}
+	var abortOnce sync.Once
+
 	//Worker pool to process requests
+	var wg sync.WaitGroup
+	wg.Add(maxConn)
 	for range maxConn {
 		go func() {
 			defer wg.Done()
 
-			for req := range reqCh {
-				conn := <-connPool //Receive connection from pool
-				resp, err := conn.Send(req)
-				if err != nil {
-					slog.Error("Failed to send request", "error", err)
-					connPool <- conn //Send connection back into pool
-					continue
+			for j := range reqCh {
+				var resp string
+				var err error
+				if limiter == nil {
+					resp, _, err = s.send(ctx, j.req)
+				} else if err = limiter.acquire(ctx); err == nil {
+					var latency time.Duration
+					resp, latency, err = s.send(ctx, j.req)
+					limiter.release(latency, err)
+				}
+				saveCh <- outcome{index: j.index, req: j.req, resp: resp, err: err}
+
+				var connErr *ConnectError
+				if errors.As(err, &connErr) {
+					slog.Error("No connection could be established", "error", err)
+					abortOnce.Do(func() {
+						run.abortErr = err
+						close(stopped)
+					})
+					return
 				}
-				saveCh <- resp
-				connPool <- conn //Send connection back into pool
 			}
 		}()
 	}
@@ -79,17 +331,128 @@ func SendAndSave(creator ConnectionCreator, saver Saver, requests []string, maxC
 	go func() {
 		wg.Wait()
 		close(saveCh)
+	}()
+
+	//Dispatch requests until all are sent, ctx is done or connecting failed
+	go func() {
+		var i int
+		var held *job
+		defer func() {
+			close(reqCh)
+			dispatched <- dispatchResult{count: i, held: held}
+		}()
 
+		for ; ; i++ {
+			if ctx.Err() != nil {
+				return
+			}
+			if window != nil {
+				select {
+				case window <- struct{}{}:
+				case <-ctx.Done():
+					return
+				case <-stopped:
+					return
+				}
+			}
+
+			var req string
+			select {
+			case r, ok := <-requests:
+				if !ok {
+					return
+				}
+				req = r
+			case <-ctx.Done():
+				return
+			case <-stopped:
+				return
+			}
+
+			select {
+			case reqCh <- job{index: i, req: req}:
+			case <-ctx.Done():
+				held = &job{index: i, req: req}
+				return
+			case <-stopped:
+				held = &job{index: i, req: req}
+				return
+			}
+		}
 	}()
 
-	// Read from saveCh and process responses
-	for resp := range saveCh {
-		saver.Save(resp)
+	// Everything below runs on this goroutine only, so saves are never concurrent
+	batchSaver, _ := saver.(BatchSaver)
+	var batch []string
+	flushTimer := time.NewTimer(cfg.batchInterval)
+	flushTimer.Stop()
+	defer flushTimer.Stop()
+
+	flush := func() {
+		flushTimer.Stop()
+		if len(batch) > 0 {
+			batchSaver.SaveBatch(batch)
+			batch = nil
+		}
+	}
+
+	emit := func(o outcome) {
+		res := Result{Index: o.index, Request: o.req, Response: o.resp, Err: o.err}
+		if o.err == nil {
+			if batchSaver == nil {
+				saver.Save(o.resp)
+			} else {
+				batch = append(batch, o.resp)
+				if len(batch) == 1 {
+					flushTimer.Reset(cfg.batchInterval)
+				}
+				if len(batch) >= cfg.batchSize {
+					flush()
+				}
+			}
+		}
+		if cfg.onResult != nil {
+			cfg.onResult(res)
+		}
 	}
 
-	// Close all connections in the pool
-	close(connPool)
-	for conn := range connPool {
-		conn.Disconnect()
+	// Read from saveCh and process responses, including the ones in flight at cancellation
+	// Requests are dispatched in order, so in ordered mode the buffer always drains
+	reorder := newReorderBuffer()
+	for done := false; !done; {
+		select {
+		case o, ok := <-saveCh:
+			if !ok {
+				done = true
+				break
+			}
+			if window == nil {
+				emit(o)
+				continue
+			}
+			for _, ready := range reorder.push(o) {
+				emit(ready)
+				<-window
+			}
+		case <-flushTimer.C:
+			flush()
+		}
+	}
+	if batchSaver != nil {
+		flush()
+	}
+
+	// Workers are done, so run.abortErr is safe to read
+	d := <-dispatched
+	if d.held != nil {
+		// Read from the input but never sent, report it like the unsent ones
+		err := ctx.Err()
+		if run.abortErr != nil {
+			err = run.abortErr
+		}
+		emit(outcome{index: d.held.index, req: d.held.req, err: err})
 	}
+	run.dispatched = d.count
+	run.connections = pool.Stats().Opened
+	return run
 }
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"math"
 	"slices"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -11,6 +15,7 @@ import (
 type MockConnection struct {
 	delay time.Duration
 	ready bool
+	errs  map[string]error
 	sync.Mutex
 }
 
@@ -30,6 +35,13 @@ func (c *MockConnection) Disconnect() {
 	c.ready = false
 }
 
+func (c *MockConnection) isReady() bool {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.ready
+}
+
 func (c *MockConnection) Send(req string) (string, error) {
 	c.Lock()
 	defer c.Unlock()
@@ -40,12 +52,16 @@ func (c *MockConnection) Send(req string) (string, error) {
 
 	// Sending request
 	<-time.After(c.delay)
+	if err := c.errs[req]; err != nil {
+		return "", err
+	}
 	return "resp:" + req, nil
 }
 
 type MockCreator struct {
 	delay       time.Duration
 	connections []Connection
+	errs        map[string]error
 	sync.Mutex
 }
 
@@ -58,7 +74,7 @@ func (c *MockCreator) NewConnection() (Connection, error) {
 	defer c.Unlock()
 
 	for i, conn := range c.connections {
-		if conn.(*MockConnection).ready {
+		if conn.(*MockConnection).isReady() {
 			c.connections = slices.Delete(c.connections, i, i+1)
 		}
 	}
@@ -70,6 +86,7 @@ func (c *MockCreator) NewConnection() (Connection, error) {
 	conn := &MockConnection{
 		ready: false,
 		delay: c.delay,
+		errs:  c.errs,
 	}
 	c.connections = append(c.connections, conn)
 	return conn, nil
@@ -128,7 +145,7 @@ func TestSendAndSave(t *testing.T) {
 			SendAndSave(creator, saver, requests, tt.maxConn)
 
 			for _, conn := range creator.connections {
-				if conn.(*MockConnection).ready {
+				if conn.(*MockConnection).isReady() {
 					t.Errorf("Connection is not closed")
 				}
 			}
@@ -153,3 +170,854 @@ func TestSendAndSave(t *testing.T) {
 		})
 	}
 }
+
+var errSend = errors.New("send failed")
+
+func TestSendAndSaveReport(t *testing.T) {
+	tests := []struct {
+		name        string
+		requests    []string
+		errs        map[string]error
+		maxConn     int
+		available   int
+		connections int
+		failed      []string
+		saved       int
+	}{
+		{
+			name:        "all succeed",
+			requests:    []string{"req1", "req2", "req3"},
+			maxConn:     2,
+			available:   2,
+			connections: 2,
+			saved:       3,
+		},
+		{
+			name:        "some requests fail",
+			requests:    []string{"req1", "req2", "req3", "req4"},
+			errs:        map[string]error{"req2": errSend, "req4": errSend},
+			maxConn:     2,
+			available:   2,
+			connections: 2,
+			failed:      []string{"req2", "req4"},
+			saved:       2,
+		},
+		{
+			name:        "no connections",
+			requests:    []string{"req1", "req2"},
+			maxConn:     2,
+			available:   0,
+			connections: 0,
+			failed:      []string{"req1", "req2"},
+			saved:       0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saver := NewUnsafeStorage(time.Millisecond)
+			creator := NewMockCreator(tt.available, time.Millisecond)
+			creator.errs = tt.errs
+
+			report := SendAndSave(creator, saver, tt.requests, tt.maxConn)
+
+			if report.Connections != tt.connections {
+				t.Errorf("Expected %d connections, got %d", tt.connections, report.Connections)
+			}
+			if !slices.Equal(report.Failed(), tt.failed) {
+				t.Errorf("Expected failed requests %v, got %v", tt.failed, report.Failed())
+			}
+			if (report.Err == nil) != (len(tt.failed) == 0) {
+				t.Errorf("Unexpected aggregate error: %v", report.Err)
+			}
+			if len(saver.data) != tt.saved {
+				t.Errorf("Expected %d saved items, got %d", tt.saved, len(saver.data))
+			}
+			for i, res := range report.Results {
+				if res.Request != tt.requests[i] {
+					t.Errorf("Result %d is for %q, expected %q", i, res.Request, tt.requests[i])
+				}
+				if res.Err == nil && res.Response != "resp:"+res.Request {
+					t.Errorf("Wrong response for %q: %q", res.Request, res.Response)
+				}
+				if tt.errs[res.Request] != nil && !errors.Is(res.Err, tt.errs[res.Request]) {
+					t.Errorf("Expected %v for %q, got %v", tt.errs[res.Request], res.Request, res.Err)
+				}
+			}
+		})
+	}
+}
+
+func TestSendAndSaveInvalidMaxConn(t *testing.T) {
+	for _, maxConn := range []int{0, -1} {
+		t.Run(fmt.Sprint(maxConn), func(t *testing.T) {
+			saver := NewUnsafeStorage(0)
+			done := make(chan *Report)
+			go func() {
+				done <- SendAndSave(&delayCreator{}, saver, []string{"req1", "req2"}, maxConn)
+			}()
+
+			var report *Report
+			select {
+			case report = <-done:
+			case <-time.After(time.Second):
+				t.Fatal("SendAndSave did not return")
+			}
+			if report.Errored != 2 || !errors.Is(report.Err, ErrInvalidMaxConn) {
+				t.Errorf("Unexpected report: %+v", report)
+			}
+			if len(saver.data) != 0 {
+				t.Errorf("Expected nothing saved, got %d items", len(saver.data))
+			}
+
+			requests := make(chan string, 1)
+			requests <- "req1"
+			close(requests)
+			stream := SendAndSaveStream(context.Background(), &delayCreator{}, saver, requests, maxConn)
+			if !errors.Is(stream.Err, ErrInvalidMaxConn) {
+				t.Errorf("Unexpected stream report: %+v", stream)
+			}
+		})
+	}
+}
+
+func TestSendAndSaveContext(t *testing.T) {
+	requests := []string{"req1", "req2", "req3", "req4", "req5", "req6", "req7", "req8", "req9", "req10"}
+	saver := NewUnsafeStorage(time.Millisecond)
+	creator := NewMockCreator(2, 20*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	report := SendAndSaveContext(ctx, creator, saver, requests, 2)
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Errorf("SendAndSaveContext did not stop on cancellation, took %v", elapsed)
+	}
+
+	for _, conn := range creator.connections {
+		if conn.(*MockConnection).isReady() {
+			t.Errorf("Connection is not closed")
+		}
+	}
+
+	var succeeded, canceled int
+	for _, res := range report.Results {
+		switch {
+		case res.Err == nil:
+			succeeded++
+		case errors.Is(res.Err, context.DeadlineExceeded):
+			canceled++
+		default:
+			t.Errorf("Unexpected error for %q: %v", res.Request, res.Err)
+		}
+	}
+	if succeeded == 0 || canceled == 0 {
+		t.Errorf("Expected both sent and canceled requests, got %d sent and %d canceled", succeeded, canceled)
+	}
+	if len(saver.data) != succeeded {
+		t.Errorf("Expected %d saved items, got %d", succeeded, len(saver.data))
+	}
+	for _, data := range saver.data {
+		if data == "" {
+			t.Errorf("data is corrupted (empty string)")
+		}
+	}
+}
+
+// flakyConnection fails the first `fails` sends of every request
+// and breaks for good after `breakAfter` successful sends
+type flakyConnection struct {
+	creator    *flakyCreator
+	breakAfter int
+	sends      int
+	broken     bool
+}
+
+func (c *flakyConnection) Connect() {}
+
+func (c *flakyConnection) Disconnect() {
+	c.creator.Lock()
+	defer c.creator.Unlock()
+	c.creator.open--
+}
+
+func (c *flakyConnection) Send(req string) (string, error) {
+	c.creator.Lock()
+	defer c.creator.Unlock()
+
+	if c.broken {
+		return "", fmt.Errorf("send %q: %w", req, ErrBrokenConnection)
+	}
+	if c.creator.attempts[req]++; c.creator.attempts[req] <= c.creator.fails {
+		return "", errSend
+	}
+	if c.sends++; c.breakAfter > 0 && c.sends >= c.breakAfter {
+		c.broken = true
+	}
+	return "resp:" + req, nil
+}
+
+type flakyCreator struct {
+	fails      int
+	breakAfter int
+	attempts   map[string]int
+	created    int
+	open       int
+	maxOpen    int
+	sync.Mutex
+}
+
+func (c *flakyCreator) NewConnection() (Connection, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.created++
+	c.open++
+	c.maxOpen = max(c.maxOpen, c.open)
+	return &flakyConnection{creator: c, breakAfter: c.breakAfter}, nil
+}
+
+func TestSendAndSaveRetry(t *testing.T) {
+	tests := []struct {
+		name       string
+		fails      int
+		breakAfter int
+		policy     RetryPolicy
+		failed     int
+		replaced   bool
+	}{
+		{
+			name:   "transient errors are retried",
+			fails:  2,
+			policy: RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, Jitter: 0.5},
+		},
+		{
+			name:   "retries exhausted",
+			fails:  2,
+			policy: RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond},
+			failed: 6,
+		},
+		{
+			name:       "broken connections are replaced",
+			breakAfter: 2,
+			// Both idle connections may be broken, the third attempt gets a new one
+			policy:   RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond},
+			replaced: true,
+		},
+	}
+
+	requests := []string{"req1", "req2", "req3", "req4", "req5", "req6"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saver := NewUnsafeStorage(time.Millisecond)
+			creator := &flakyCreator{fails: tt.fails, breakAfter: tt.breakAfter, attempts: map[string]int{}}
+
+			report := SendAndSaveContext(context.Background(), creator, saver, requests, 2, WithRetry(tt.policy))
+
+			if failed := len(report.Failed()); failed != tt.failed {
+				t.Errorf("Expected %d failed requests, got %d: %v", tt.failed, failed, report.Err)
+			}
+			if len(saver.data) != len(requests)-tt.failed {
+				t.Errorf("Expected %d saved items, got %d", len(requests)-tt.failed, len(saver.data))
+			}
+			if creator.open != 0 {
+				t.Errorf("%d connections were not disconnected", creator.open)
+			}
+			if creator.maxOpen > 2 {
+				t.Errorf("Expected at most 2 open connections, got %d", creator.maxOpen)
+			}
+			if tt.replaced != (creator.created > 2) {
+				t.Errorf("Unexpected number of created connections: %d", creator.created)
+			}
+			if report.Connections != creator.created {
+				t.Errorf("Expected %d connections in report, got %d", creator.created, report.Connections)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   RetryPolicy
+		retries  []int
+		expected []time.Duration
+	}{
+		{
+			name:     "doubles up to the cap",
+			policy:   RetryPolicy{BaseDelay: 10 * time.Millisecond, MaxDelay: 50 * time.Millisecond},
+			retries:  []int{1, 2, 3, 4, 5},
+			expected: []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond, 50 * time.Millisecond, 50 * time.Millisecond},
+		},
+		{
+			name:     "no base delay never waits",
+			policy:   RetryPolicy{MaxAttempts: 3, MaxDelay: time.Second},
+			retries:  []int{1, 2, 100},
+			expected: []time.Duration{0, 0, 0},
+		},
+		{
+			name:     "overflow is capped",
+			policy:   RetryPolicy{BaseDelay: time.Second, MaxDelay: time.Minute},
+			retries:  []int{40, 64, 100},
+			expected: []time.Duration{time.Minute, time.Minute, time.Minute},
+		},
+		{
+			name:     "overflow without a cap",
+			policy:   RetryPolicy{BaseDelay: time.Second},
+			retries:  []int{40, 100},
+			expected: []time.Duration{math.MaxInt64, math.MaxInt64},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, n := range tt.retries {
+				if got := tt.policy.backoff(n); got != tt.expected[i] {
+					t.Errorf("Retry %d: expected %v, got %v", n, tt.expected[i], got)
+				}
+			}
+		})
+	}
+
+	policy := RetryPolicy{BaseDelay: 10 * time.Millisecond, MaxDelay: 50 * time.Millisecond, Jitter: 0.5}
+	expected := []time.Duration{10, 20, 40, 50, 50}
+	for n := 1; n <= 5; n++ {
+		got, ceiling := policy.backoff(n), expected[n-1]*time.Millisecond
+		if got > ceiling || got < ceiling/2 {
+			t.Errorf("Retry %d: jittered delay %v outside [%v, %v]", n, got, ceiling/2, ceiling)
+		}
+	}
+}
+
+func TestPool(t *testing.T) {
+	creator := &flakyCreator{attempts: map[string]int{}}
+	pool := NewPool(creator, PoolConfig{MaxSize: 2})
+	ctx := context.Background()
+
+	first, err := pool.Acquire(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	second, _ := pool.Acquire(ctx)
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := pool.Acquire(timeoutCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Acquire on exhausted pool should wait for ctx, got: %v", err)
+	}
+
+	pool.Release(first)
+	if conn, _ := pool.Acquire(ctx); conn != first {
+		t.Errorf("Expected idle connection to be reused")
+	}
+	pool.Discard(second)
+	if stats := pool.Stats(); stats.Open != 1 || stats.InUse != 1 || stats.Opened != 2 {
+		t.Errorf("Unexpected stats after Discard: %+v", stats)
+	}
+
+	released := make(chan struct{})
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(released)
+		pool.Release(first)
+	}()
+	pool.Close()
+	select {
+	case <-released:
+	default:
+		t.Errorf("Close returned before the connection in use was released")
+	}
+
+	if creator.open != 0 {
+		t.Errorf("%d connections were not disconnected by Close", creator.open)
+	}
+	if _, err := pool.Acquire(ctx); err != ErrPoolClosed {
+		t.Errorf("Expected ErrPoolClosed, got: %v", err)
+	}
+	pool.Close()
+}
+
+func TestPoolExpiration(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    PoolConfig
+		wait   time.Duration
+		reused bool
+	}{
+		{
+			name:   "idle connection reused",
+			cfg:    PoolConfig{MaxSize: 1, IdleTimeout: time.Second},
+			reused: true,
+		},
+		{
+			name: "idle timeout",
+			cfg:  PoolConfig{MaxSize: 1, IdleTimeout: 20 * time.Millisecond},
+			wait: 60 * time.Millisecond,
+		},
+		{
+			name: "max lifetime",
+			cfg:  PoolConfig{MaxSize: 1, MaxLifetime: 20 * time.Millisecond},
+			wait: 30 * time.Millisecond,
+		},
+		{
+			name: "failed health check",
+			cfg: PoolConfig{MaxSize: 1, HealthCheck: func(conn Connection) error {
+				if conn.(*flakyConnection).broken {
+					return ErrBrokenConnection
+				}
+				return nil
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			creator := &flakyCreator{attempts: map[string]int{}}
+			pool := NewPool(creator, tt.cfg)
+			defer pool.Close()
+
+			conn, _ := pool.Acquire(context.Background())
+			conn.(*flakyConnection).broken = tt.cfg.HealthCheck != nil
+			pool.Release(conn)
+			time.Sleep(tt.wait)
+
+			next, _ := pool.Acquire(context.Background())
+			if (next == conn) != tt.reused {
+				t.Errorf("Expected reused=%v, got a different answer", tt.reused)
+			}
+			pool.Release(next)
+
+			creator.Lock()
+			defer creator.Unlock()
+			if creator.open != 1 {
+				t.Errorf("Expected exactly one open connection, got %d", creator.open)
+			}
+		})
+	}
+}
+
+// delayCreator creates connections whose Send takes delays[req]
+type delayCreator struct {
+	delays  map[string]time.Duration
+	started atomic.Int32
+}
+
+type delayConnection struct {
+	creator *delayCreator
+}
+
+func (c *delayCreator) NewConnection() (Connection, error) {
+	return &delayConnection{creator: c}, nil
+}
+
+func (c *delayConnection) Connect()    {}
+func (c *delayConnection) Disconnect() {}
+
+func (c *delayConnection) Send(req string) (string, error) {
+	c.creator.started.Add(1)
+	time.Sleep(c.creator.delays[req])
+	return "resp:" + req, nil
+}
+
+func TestSendAndSaveOrdered(t *testing.T) {
+	requests := []string{"req1", "req2", "req3", "req4", "req5", "req6"}
+	creator := &delayCreator{delays: map[string]time.Duration{
+		"req1": 100 * time.Millisecond,
+		"req3": 30 * time.Millisecond,
+	}}
+	saver := NewUnsafeStorage(0)
+
+	startedBeforeSlow := make(chan int32, 1)
+	go func() {
+		time.Sleep(80 * time.Millisecond)
+		startedBeforeSlow <- creator.started.Load()
+	}()
+
+	report := SendAndSaveContext(context.Background(), creator, saver, requests, 4, WithOrder(2))
+	if report.Err != nil {
+		t.Fatalf("Unexpected error: %v", report.Err)
+	}
+
+	expected := make([]string, len(requests))
+	for i, req := range requests {
+		expected[i] = "resp:" + req
+	}
+	if !slices.Equal(saver.data, expected) {
+		t.Errorf("Responses saved out of order: %v", saver.data)
+	}
+	if started := <-startedBeforeSlow; started > 2 {
+		t.Errorf("Expected at most 2 requests in flight behind the slow one, got %d", started)
+	}
+}
+
+type UnsafeBatchStorage struct {
+	*UnsafeStorage
+	batches [][]string
+}
+
+func (s *UnsafeBatchStorage) SaveBatch(data []string) {
+	select {
+	case s.sem <- struct{}{}:
+		defer func() { <-s.sem }()
+	default:
+		data = nil // corrupt batch
+	}
+	<-time.After(s.delay)
+
+	s.Lock()
+	defer s.Unlock()
+	s.batches = append(s.batches, data)
+	s.data = append(s.data, data...)
+}
+
+func TestSendAndSaveBatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		delays   map[string]time.Duration
+		size     int
+		interval time.Duration
+		batches  []int
+	}{
+		{
+			name:     "flush by size",
+			size:     2,
+			interval: time.Second,
+			batches:  []int{2, 2, 1},
+		},
+		{
+			name:     "flush by time",
+			delays:   map[string]time.Duration{"req4": 100 * time.Millisecond, "req5": 100 * time.Millisecond},
+			size:     10,
+			interval: 30 * time.Millisecond,
+			batches:  []int{3, 2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := []string{"req1", "req2", "req3", "req4", "req5"}
+			saver := &UnsafeBatchStorage{UnsafeStorage: NewUnsafeStorage(time.Millisecond)}
+			creator := &delayCreator{delays: tt.delays}
+
+			report := SendAndSaveContext(context.Background(), creator, saver, requests, 5, WithOrder(5), WithBatchSave(tt.size, tt.interval))
+			if report.Err != nil {
+				t.Fatalf("Unexpected error: %v", report.Err)
+			}
+
+			sizes := make([]int, len(saver.batches))
+			for i, batch := range saver.batches {
+				if batch == nil {
+					t.Errorf("batch %d is corrupted", i)
+				}
+				sizes[i] = len(batch)
+			}
+			if !slices.Equal(sizes, tt.batches) {
+				t.Errorf("Expected batch sizes %v, got %v", tt.batches, sizes)
+			}
+			if len(saver.data) != len(requests) {
+				t.Errorf("Expected %d saved items, got %d", len(requests), len(saver.data))
+			}
+		})
+	}
+}
+
+func TestSendAndSaveStream(t *testing.T) {
+	const total, maxConn = 200, 3
+	saver := NewUnsafeStorage(time.Millisecond)
+	creator := &delayCreator{}
+
+	var produced, handled, maxPending atomic.Int64
+	requests := make(chan string)
+	go func() {
+		defer close(requests)
+		for i := range total {
+			requests <- fmt.Sprintf("req%d", i)
+			pending := produced.Add(1) - handled.Load()
+			if pending > maxPending.Load() {
+				maxPending.Store(pending)
+			}
+		}
+	}()
+
+	report := SendAndSaveStream(context.Background(), creator, saver, requests, maxConn,
+		WithResultHandler(func(res Result) {
+			handled.Add(1)
+			if res.Response != "resp:"+res.Request {
+				t.Errorf("Wrong response for %q: %q", res.Request, res.Response)
+			}
+		}))
+
+	if report.Err != nil || report.Succeeded != total || report.Errored != 0 {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+	if report.Results != nil {
+		t.Errorf("Stream report should not keep per-request results")
+	}
+	if len(saver.data) != total {
+		t.Errorf("Expected %d saved items, got %d", total, len(saver.data))
+	}
+	// Requests are held by the dispatcher, the workers, saveCh and the saver at most
+	if bound := int64(2*maxConn + 2); maxPending.Load() > bound {
+		t.Errorf("Expected at most %d requests read ahead of the saver, got %d", bound, maxPending.Load())
+	}
+}
+
+func TestSendAndSaveStreamCancel(t *testing.T) {
+	saver := NewUnsafeStorage(0)
+	requests := make(chan string)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		requests <- "req1"
+	}()
+
+	report := SendAndSaveStream(ctx, &delayCreator{}, saver, requests, 2,
+		WithResultHandler(func(Result) { cancel() }))
+	if report.Succeeded != 1 || report.Err != nil {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+}
+
+// limitedCreator fails NewConnection once `allowed` connections were created
+type limitedCreator struct {
+	delayCreator
+	allowed atomic.Int32
+	created atomic.Int32
+}
+
+func (c *limitedCreator) NewConnection() (Connection, error) {
+	if c.created.Add(1) > c.allowed.Load() {
+		c.created.Add(-1)
+		return nil, errors.New("too many connections")
+	}
+	return c.delayCreator.NewConnection()
+}
+
+func TestSendAndSaveDegraded(t *testing.T) {
+	tests := []struct {
+		name        string
+		allowed     int32
+		allowLater  int32
+		connections int
+		failed      int
+	}{
+		{
+			name:        "fewer connections than maxConn",
+			allowed:     2,
+			connections: 2,
+		},
+		{
+			name:       "more connections become available",
+			allowed:    1,
+			allowLater: 4,
+		},
+		{
+			name:    "no connections",
+			allowed: 0,
+			failed:  20,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := make([]string, 20)
+			delays := map[string]time.Duration{}
+			for i := range requests {
+				requests[i] = fmt.Sprintf("req%d", i)
+				delays[requests[i]] = 20 * time.Millisecond
+			}
+
+			creator := &limitedCreator{delayCreator: delayCreator{delays: delays}}
+			creator.allowed.Store(tt.allowed)
+			if tt.allowLater > 0 {
+				time.AfterFunc(50*time.Millisecond, func() { creator.allowed.Store(tt.allowLater) })
+			}
+
+			saver := NewUnsafeStorage(0)
+			report := SendAndSave(creator, saver, requests, 4)
+
+			if report.Errored != tt.failed {
+				t.Errorf("Expected %d failed requests, got %d: %v", tt.failed, report.Errored, report.Err)
+			}
+			if len(saver.data) != len(requests)-tt.failed {
+				t.Errorf("Expected %d saved items, got %d", len(requests)-tt.failed, len(saver.data))
+			}
+			if tt.allowLater > 0 {
+				if report.Connections <= int(tt.allowed) {
+					t.Errorf("Expected connections to be opened in the background, got %d", report.Connections)
+				}
+			} else if report.Connections != tt.connections {
+				t.Errorf("Expected %d connections, got %d", tt.connections, report.Connections)
+			}
+			if tt.failed > 0 {
+				var connErr *ConnectError
+				if !errors.As(report.Err, &connErr) {
+					t.Errorf("Expected *ConnectError, got %v", report.Err)
+				}
+			}
+		})
+	}
+}
+
+func TestAIMDLimiter(t *testing.T) {
+	limiter := newAIMDLimiter(AdaptiveLimit{Initial: 2, BackoffRatio: 0.5}, 4)
+	ctx := context.Background()
+
+	steps := []struct {
+		name    string
+		latency time.Duration
+		err     error
+		limit   int
+	}{
+		{name: "flat latency grows", latency: 10 * time.Millisecond, limit: 3},
+		{name: "still flat grows", latency: 12 * time.Millisecond, limit: 4},
+		{name: "capped at max", latency: 10 * time.Millisecond, limit: 4},
+		{name: "latency spike shrinks", latency: 50 * time.Millisecond, limit: 2},
+		{name: "error shrinks", latency: 10 * time.Millisecond, err: errSend, limit: 1},
+		{name: "never below one", latency: 10 * time.Millisecond, err: errSend, limit: 1},
+	}
+
+	for _, step := range steps {
+		// Keep the limit fully used so it is allowed to grow
+		n := limiter.current()
+		for range n {
+			if err := limiter.acquire(ctx); err != nil {
+				t.Fatalf("%s: unexpected error: %v", step.name, err)
+			}
+		}
+		limiter.release(step.latency, step.err)
+
+		// Drop the other slots without recording samples for them
+		limiter.mu.Lock()
+		limiter.inflight -= n - 1
+		limiter.mu.Unlock()
+
+		if got := limiter.current(); got != step.limit {
+			t.Errorf("%s: expected limit %d, got %d", step.name, step.limit, got)
+		}
+	}
+
+	for range limiter.current() {
+		limiter.acquire(ctx)
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := limiter.acquire(timeoutCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("acquire over the limit should wait for ctx, got: %v", err)
+	}
+}
+
+func TestAIMDLimiterRecovers(t *testing.T) {
+	limiter := newAIMDLimiter(AdaptiveLimit{Initial: 4, BackoffRatio: 0.5, Window: 10}, 4)
+	ctx := context.Background()
+
+	sample := func(latency time.Duration) int {
+		n := limiter.current()
+		for range n {
+			limiter.acquire(ctx)
+		}
+		limiter.release(latency, nil)
+		limiter.mu.Lock()
+		limiter.inflight -= n - 1
+		limiter.mu.Unlock()
+		return limiter.current()
+	}
+
+	for range 10 {
+		sample(10 * time.Millisecond)
+	}
+	// A lasting slowdown shrinks the limit, until it becomes the new baseline
+	lowest := 4
+	for range 10 {
+		lowest = min(lowest, sample(100*time.Millisecond))
+	}
+	if lowest != 1 {
+		t.Errorf("Expected the slowdown to shrink the limit to 1, got %d", lowest)
+	}
+	for range 5 {
+		sample(100 * time.Millisecond)
+	}
+	if got := limiter.current(); got != 4 {
+		t.Errorf("Expected the limit to recover to 4 after a full window, got %d", got)
+	}
+}
+
+func TestSenderLatency(t *testing.T) {
+	creator := &congestedCreator{capacity: 1, connect: 50 * time.Millisecond}
+	pool := NewPool(creator, PoolConfig{MaxSize: 1})
+	defer pool.Close()
+	s := &sender{pool: pool}
+
+	_, latency, err := s.send(context.Background(), "req1")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if latency >= creator.connect {
+		t.Errorf("Latency should only cover Send, not connecting, got %v", latency)
+	}
+}
+
+// congestedCreator creates connections that get slow when more than `capacity` sends run at once
+// Connecting takes `connect`
+type congestedCreator struct {
+	capacity    int32
+	connect     time.Duration
+	inflight    atomic.Int32
+	maxInflight atomic.Int32
+}
+
+type congestedConnection struct {
+	creator *congestedCreator
+}
+
+func (c *congestedCreator) NewConnection() (Connection, error) {
+	return &congestedConnection{creator: c}, nil
+}
+
+func (c *congestedConnection) Connect()    { time.Sleep(c.creator.connect) }
+func (c *congestedConnection) Disconnect() {}
+
+func (c *congestedConnection) Send(req string) (string, error) {
+	n := c.creator.inflight.Add(1)
+	defer c.creator.inflight.Add(-1)
+	for peak := c.creator.maxInflight.Load(); n > peak && !c.creator.maxInflight.CompareAndSwap(peak, n); {
+		peak = c.creator.maxInflight.Load()
+	}
+
+	if n > c.creator.capacity {
+		time.Sleep(20 * time.Millisecond)
+	} else {
+		time.Sleep(2 * time.Millisecond)
+	}
+	return "resp:" + req, nil
+}
+
+func TestSendAndSaveAdaptive(t *testing.T) {
+	requests := make([]string, 200)
+	for i := range requests {
+		requests[i] = fmt.Sprintf("req%d", i)
+	}
+
+	run := func(opts ...Option) (*Report, int32) {
+		creator := &congestedCreator{capacity: 2}
+		report := SendAndSaveContext(context.Background(), creator, NewUnsafeStorage(0), requests, 16, opts...)
+		return report, creator.maxInflight.Load()
+	}
+
+	fixed, fixedPeak := run()
+	adaptive, adaptivePeak := run(WithAdaptiveLimit(AdaptiveLimit{}))
+
+	if fixed.Err != nil || adaptive.Err != nil {
+		t.Fatalf("Unexpected errors: %v, %v", fixed.Err, adaptive.Err)
+	}
+	if adaptivePeak > 16 {
+		t.Errorf("Adaptive limit exceeded maxConn: %d", adaptivePeak)
+	}
+	if adaptivePeak >= fixedPeak {
+		t.Errorf("Expected adaptive limit to keep concurrency below %d, got %d", fixedPeak, adaptivePeak)
+	}
+	if adaptive.Connections >= fixed.Connections {
+		t.Errorf("Expected adaptive limit to open fewer than %d connections, got %d", fixed.Connections, adaptive.Connections)
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// Limiter is implemented by every limiting algorithm in this package
+type Limiter interface {
+	// CanTake returns immediately, reporting whether the operation is allowed
+	CanTake() bool
+	// Take blocks until the operation is allowed
+	Take()
+	// Wait blocks until the operation is allowed or ctx is done
+	Wait(ctx context.Context) error
+}
+
+var (
+	_ Limiter = (*RateLimiter)(nil)
+	_ Limiter = (*FixedWindow)(nil)
+	_ Limiter = (*SlidingWindowLog)(nil)
+	_ Limiter = (*SlidingWindowCounter)(nil)
+	_ Limiter = (*LeakyBucket)(nil)
+)
+
+// ErrBucketFull is returned by LeakyBucket.Wait when its queue is full
+var ErrBucketFull = errors.New("leaky bucket is full")
+
+// wait calls try until it allows the operation, sleeping for the delay it returns in between
+// If ctx has a deadline that would pass before that delay, it fails right away with context.DeadlineExceeded
+func wait(ctx context.Context, clock Clock, try func(now time.Time) (bool, time.Duration)) error {
+	return waitNotify(ctx, clock, func(t time.Time) (bool, time.Duration, <-chan struct{}, error) {
+		ok, delay := try(t)
+		return ok, delay, nil, nil
+	})
+}
+
+// waitNotify is wait for limiters whose settings can change while callers wait, or that can fail
+// try also returns a channel closed on such a change, which makes the caller try again early,
+// and an error that ends the wait
+func waitNotify(ctx context.Context, clock Clock, try func(now time.Time) (bool, time.Duration, <-chan struct{}, error)) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		t := clock.Now()
+		ok, delay, changed, err := try(t)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		if deadline, has := ctx.Deadline(); has && delay > deadline.Sub(t) {
+			return context.DeadlineExceeded
+		}
+
+		timer := clock.NewTimer(delay)
+		select {
+		case <-timer.C():
+		case <-changed:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// validateWindow checks the settings of the window algorithms
+func validateWindow(limit int, window time.Duration) error {
+	if limit < 1 {
+		return ErrInvalidLimit
+	}
+	if window <= 0 {
+		return ErrInvalidWindow
+	}
+	return nil
+}
+
+// rateInterval returns the time between two operations at rate per second
+// The rate must be positive and low enough for the interval to fit a time.Duration
+func rateInterval(rate float64) (time.Duration, error) {
+	interval := float64(time.Second) / rate
+	if !(rate > 0) || interval >= math.MaxInt64 {
+		return 0, ErrInvalidRate
+	}
+	return time.Duration(interval), nil
+}
+
+// FixedWindow allows limit operations per window, counting from the start of each window
+// It is the cheapest algorithm, but allows up to twice the limit around a window boundary
+type FixedWindow struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	start  time.Time
+	count  int
+	clock  Clock
+}
+
+// NewFixedWindow creates a FixedWindow limiter with windows starting now
+// The limit must be at least 1 and the window positive
+func NewFixedWindow(limit int, window time.Duration, opts ...Option) (*FixedWindow, error) {
+	if err := validateWindow(limit, window); err != nil {
+		return nil, err
+	}
+	clock := newOptions(opts).clock
+	return &FixedWindow{limit: limit, window: window, start: clock.Now(), clock: clock}, nil
+}
+
+func (l *FixedWindow) CanTake() bool {
+	ok, _ := l.tryTake(l.clock.Now())
+	return ok
+}
+
+func (l *FixedWindow) Take() {
+	_ = l.Wait(context.Background())
+}
+
+func (l *FixedWindow) Wait(ctx context.Context) error {
+	return wait(ctx, l.clock, l.tryTake)
+}
+
+func (l *FixedWindow) tryTake(now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if elapsed := now.Sub(l.start); elapsed >= l.window {
+		l.start = l.start.Add(elapsed.Truncate(l.window))
+		l.count = 0
+	}
+	if l.count < l.limit {
+		l.count++
+		return true, 0
+	}
+	return false, l.start.Add(l.window).Sub(now)
+}
+
+// SlidingWindowLog allows limit operations in any window-long interval
+// It is exact, but keeps a timestamp for every operation in the last window
+type SlidingWindowLog struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	log    []time.Time // oldest first
+	clock  Clock
+}
+
+// NewSlidingWindowLog creates a SlidingWindowLog limiter
+// The limit must be at least 1 and the window positive
+func NewSlidingWindowLog(limit int, window time.Duration, opts ...Option) (*SlidingWindowLog, error) {
+	if err := validateWindow(limit, window); err != nil {
+		return nil, err
+	}
+	clock := newOptions(opts).clock
+	return &SlidingWindowLog{limit: limit, window: window, log: make([]time.Time, 0, limit), clock: clock}, nil
+}
+
+func (l *SlidingWindowLog) CanTake() bool {
+	ok, _ := l.tryTake(l.clock.Now())
+	return ok
+}
+
+func (l *SlidingWindowLog) Take() {
+	_ = l.Wait(context.Background())
+}
+
+func (l *SlidingWindowLog) Wait(ctx context.Context) error {
+	return wait(ctx, l.clock, l.tryTake)
+}
+
+func (l *SlidingWindowLog) tryTake(now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	expired := 0
+	for expired < len(l.log) && now.Sub(l.log[expired]) >= l.window {
+		expired++
+	}
+	l.log = append(l.log[:0], l.log[expired:]...)
+
+	if len(l.log) < l.limit {
+		l.log = append(l.log, now)
+		return true, 0
+	}
+	return false, l.log[0].Add(l.window).Sub(now)
+}
+
+// SlidingWindowCounter approximates a sliding window from the counts of the current
+// and the previous fixed window, weighting the previous one by how much of it still overlaps
+// It smooths the boundary burst of FixedWindow using constant memory
+type SlidingWindowCounter struct {
+	mu       sync.Mutex
+	limit    int
+	window   time.Duration
+	start    time.Time
+	previous int
+	current  int
+	clock    Clock
+}
+
+// NewSlidingWindowCounter creates a SlidingWindowCounter limiter with windows starting now
+// The limit must be at least 1 and the window positive
+func NewSlidingWindowCounter(limit int, window time.Duration, opts ...Option) (*SlidingWindowCounter, error) {
+	if err := validateWindow(limit, window); err != nil {
+		return nil, err
+	}
+	clock := newOptions(opts).clock
+	return &SlidingWindowCounter{limit: limit, window: window, start: clock.Now(), clock: clock}, nil
+}
+
+func (l *SlidingWindowCounter) CanTake() bool {
+	ok, _ := l.tryTake(l.clock.Now())
+	return ok
+}
+
+func (l *SlidingWindowCounter) Take() {
+	_ = l.Wait(context.Background())
+}
+
+func (l *SlidingWindowCounter) Wait(ctx context.Context) error {
+	return wait(ctx, l.clock, l.tryTake)
+}
+
+func (l *SlidingWindowCounter) tryTake(now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if elapsed := now.Sub(l.start); elapsed >= l.window {
+		l.previous, l.current = l.current, 0
+		if elapsed >= 2*l.window {
+			l.previous = 0
+		}
+		l.start = l.start.Add(elapsed.Truncate(l.window))
+	}
+
+	elapsed := now.Sub(l.start)
+	overlap := 1 - float64(elapsed)/float64(l.window)
+	if float64(l.previous)*overlap+float64(l.current)+1 <= float64(l.limit) {
+		l.current++
+		return true, 0
+	}
+
+	// Wait until enough of the previous window has slid out, or for the next window
+	// if the current one alone is at the limit
+	free := float64(l.limit - l.current - 1)
+	if free < 0 || l.previous == 0 {
+		return false, l.start.Add(l.window).Sub(now)
+	}
+	until := time.Duration((1 - free/float64(l.previous)) * float64(l.window))
+	return false, max(until-elapsed, time.Nanosecond)
+}
+
+// LeakyBucket spaces operations evenly at rate per second, without bursts
+// Callers of Wait queue for their slot, and up to capacity of them may be queued
+type LeakyBucket struct {
+	mu       sync.Mutex
+	interval time.Duration
+	capacity int
+	next     time.Time // earliest time the next operation may run
+	clock    Clock
+}
+
+// NewLeakyBucket creates a LeakyBucket letting rate operations per second through
+// The rate must be positive, a capacity of 0 means Wait never queues
+func NewLeakyBucket(rate float64, capacity int, opts ...Option) (*LeakyBucket, error) {
+	interval, err := rateInterval(rate)
+	if err != nil {
+		return nil, err
+	}
+	if capacity < 0 {
+		return nil, ErrInvalidCapacity
+	}
+	clock := newOptions(opts).clock
+	return &LeakyBucket{
+		interval: interval,
+		capacity: capacity,
+		next:     clock.Now(),
+		clock:    clock,
+	}, nil
+}
+
+// CanTake only allows an operation if its slot is now, it never queues
+func (l *LeakyBucket) CanTake() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now()
+	if now.Before(l.next) {
+		return false
+	}
+	l.next = now.Add(l.interval)
+	return true
+}
+
+// Take blocks until the operation's slot, retrying while the queue is full
+func (l *LeakyBucket) Take() {
+	for l.Wait(context.Background()) == ErrBucketFull {
+		<-l.clock.After(l.interval)
+	}
+}
+
+// Wait reserves the next free slot and blocks until it, or until ctx is done
+// It returns ErrBucketFull without waiting if capacity callers are already queued
+func (l *LeakyBucket) Wait(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	now := l.clock.Now()
+	slot := l.next
+	if slot.Before(now) {
+		slot = now
+	}
+	delay := slot.Sub(now)
+	if delay > time.Duration(l.capacity)*l.interval {
+		l.mu.Unlock()
+		return ErrBucketFull
+	}
+	if deadline, ok := ctx.Deadline(); ok && slot.After(deadline) {
+		l.mu.Unlock()
+		return context.DeadlineExceeded
+	}
+	l.next = slot.Add(l.interval)
+	l.mu.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+	timer := l.clock.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+		return nil
+	case <-ctx.Done():
+		// The slot stays taken, the bucket can't tell which later slots were handed out
+		return ctx.Err()
+	}
+}
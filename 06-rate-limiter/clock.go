@@ -0,0 +1,213 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the source of time used by the limiters
+// The default is the system clock, tests use a FakeClock to step time exactly
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+	After(d time.Duration) <-chan time.Time
+}
+
+// Timer is the part of time.Timer the limiters use
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// Ticker is the part of time.Ticker the limiters use
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Option configures a limiter
+type Option func(*options)
+
+type options struct {
+	clock Clock
+}
+
+// WithClock makes the limiter read time from clock instead of the system clock
+func WithClock(clock Clock) Option {
+	return func(o *options) {
+		o.clock = clock
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := options{clock: systemClock{}}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// systemClock is the Clock backed by package time
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTimer struct{ *time.Timer }
+
+func (t systemTimer) C() <-chan time.Time { return t.Timer.C }
+
+type systemTicker struct{ *time.Ticker }
+
+func (t systemTicker) C() <-chan time.Time { return t.Ticker.C }
+
+// FakeClock is a Clock that only moves when advanced
+// Timers and tickers fire synchronously inside Advance, in the order they are due
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*fakeTimer
+	armed   *sync.Cond // broadcast whenever a timer or ticker is armed
+}
+
+// NewFakeClock creates a FakeClock set to now
+func NewFakeClock(now time.Time) *FakeClock {
+	c := &FakeClock{now: now}
+	c.armed = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *FakeClock) NewTimer(d time.Duration) Timer {
+	return c.newTimer(d, 0)
+}
+
+// NewTicker panics on a non-positive d, like time.NewTicker
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for FakeClock.NewTicker")
+	}
+	return fakeTicker{c.newTimer(d, d)}
+}
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+// Advance moves the clock forward by d, firing every timer and tick due on the way
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	target := c.now.Add(d)
+	for {
+		next := -1
+		for i, t := range c.waiters {
+			if !t.at.After(target) && (next < 0 || t.at.Before(c.waiters[next].at)) {
+				next = i
+			}
+		}
+		if next < 0 {
+			break
+		}
+
+		t := c.waiters[next]
+		c.now = t.at
+		select {
+		case t.c <- t.at:
+		default: // like a time.Ticker, drop ticks nobody is receiving
+		}
+		if t.period > 0 {
+			t.at = t.at.Add(t.period)
+		} else {
+			c.remove(t)
+		}
+	}
+	c.now = target
+}
+
+// BlockUntil blocks until at least n timers and tickers are armed
+// Use it to make sure a goroutine is waiting on the clock before advancing it
+func (c *FakeClock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.waiters) < n {
+		c.armed.Wait()
+	}
+}
+
+func (c *FakeClock) newTimer(d, period time.Duration) *fakeTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &fakeTimer{clock: c, c: make(chan time.Time, 1), period: period}
+	c.arm(t, d)
+	return t
+}
+
+// arm schedules t, which must not be scheduled already, to fire d from now
+// Must be called with c.mu held
+func (c *FakeClock) arm(t *fakeTimer, d time.Duration) {
+	t.at = c.now.Add(d)
+	c.waiters = append(c.waiters, t)
+	c.armed.Broadcast()
+}
+
+// remove unschedules t and reports whether it was scheduled
+// Must be called with c.mu held
+func (c *FakeClock) remove(t *fakeTimer) bool {
+	for i, w := range c.waiters {
+		if w == t {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// fakeTimer is a FakeClock timer, or the ticker behind a fakeTicker if period is set
+type fakeTimer struct {
+	clock  *FakeClock
+	c      chan time.Time
+	at     time.Time
+	period time.Duration
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	return t.clock.remove(t)
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	active := t.clock.remove(t)
+	t.clock.arm(t, d)
+	return active
+}
+
+type fakeTicker struct{ *fakeTimer }
+
+func (t fakeTicker) Stop() { t.fakeTimer.Stop() }
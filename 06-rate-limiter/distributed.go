@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Store is state shared by limiters in several processes, e.g. replicas of a service
+// Values are int64 counters that expire, so keys of past windows don't pile up.
+// A missing or expired key reads as zero. Every operation must be atomic across processes
+type Store interface {
+	// Increment adds delta to key and returns the new value
+	// If key is missing or expired it starts from zero and expires ttl from now,
+	// otherwise its expiry is left unchanged
+	Increment(key string, delta int64, ttl time.Duration) (int64, error)
+
+	// Get returns the value of key
+	Get(key string) (int64, error)
+
+	// CompareAndSwap sets key to new, expiring ttl from now, if it still holds old
+	// and reports whether it did
+	CompareAndSwap(key string, old, new int64, ttl time.Duration) (bool, error)
+}
+
+var (
+	_ Limiter = (*DistributedBucket)(nil)
+	_ Limiter = (*DistributedWindow)(nil)
+)
+
+// DistributedBucket is a token bucket whose state lives in a Store, so every limiter
+// using the same store and key shares one quota
+// The state is a single timestamp, the time the bucket will be full again
+// (the generic cell rate algorithm), updated with CompareAndSwap
+type DistributedBucket struct {
+	store    Store
+	key      string
+	interval time.Duration // between two tokens
+	burst    int
+	clock    Clock
+}
+
+// NewDistributedBucket creates a DistributedBucket refilled at rate tokens per second
+// that allows bursts of up to burst operations
+// The rate must be positive and the burst at least 1
+func NewDistributedBucket(store Store, key string, rate float64, burst int, opts ...Option) (*DistributedBucket, error) {
+	interval, err := rateInterval(rate)
+	if err != nil {
+		return nil, err
+	}
+	if burst < 1 {
+		return nil, ErrInvalidBurst
+	}
+	return &DistributedBucket{
+		store:    store,
+		key:      key,
+		interval: interval,
+		burst:    burst,
+		clock:    newOptions(opts).clock,
+	}, nil
+}
+
+// CanTake takes a token if one is available and reports whether it did
+// A store error denies the operation
+func (l *DistributedBucket) CanTake() bool {
+	ok, _, err := l.tryTake(l.clock.Now())
+	return ok && err == nil
+}
+
+func (l *DistributedBucket) Take() {
+	_ = l.Wait(context.Background())
+}
+
+// Wait blocks until a token is available and takes it, or until ctx is done or the store fails
+func (l *DistributedBucket) Wait(ctx context.Context) error {
+	return waitStore(ctx, l.clock, l.tryTake)
+}
+
+func (l *DistributedBucket) tryTake(now time.Time) (bool, time.Duration, error) {
+	for {
+		full, err := l.store.Get(l.key)
+		if err != nil {
+			return false, 0, err
+		}
+
+		// Taking a token pushes the time the bucket is full by one interval,
+		// which is allowed as long as it stays within burst intervals from now
+		next := max(full, now.UnixNano()) + int64(l.interval)
+		if wait := time.Duration(next - now.UnixNano() - int64(l.burst)*int64(l.interval)); wait > 0 {
+			return false, wait, nil
+		}
+
+		ok, err := l.store.CompareAndSwap(l.key, full, next, time.Duration(next-now.UnixNano()))
+		if err != nil {
+			return false, 0, err
+		}
+		if ok {
+			return true, 0, nil
+		}
+		// Another limiter took a token in between, try again with its state
+	}
+}
+
+// DistributedWindow is a FixedWindow whose counts live in a Store,
+// so every limiter using the same store and key shares one quota
+// It only needs Increment, which most stores support natively
+type DistributedWindow struct {
+	store  Store
+	key    string
+	limit  int
+	window time.Duration
+	clock  Clock
+}
+
+// NewDistributedWindow creates a DistributedWindow allowing limit operations per window
+// Windows are aligned to the Unix epoch so all limiters agree on them
+// The limit must be at least 1 and the window positive
+func NewDistributedWindow(store Store, key string, limit int, window time.Duration, opts ...Option) (*DistributedWindow, error) {
+	if err := validateWindow(limit, window); err != nil {
+		return nil, err
+	}
+	return &DistributedWindow{store: store, key: key, limit: limit, window: window, clock: newOptions(opts).clock}, nil
+}
+
+// CanTake reports whether the operation is allowed in the current window
+// A store error denies the operation
+func (l *DistributedWindow) CanTake() bool {
+	ok, _, err := l.tryTake(l.clock.Now())
+	return ok && err == nil
+}
+
+func (l *DistributedWindow) Take() {
+	_ = l.Wait(context.Background())
+}
+
+// Wait blocks until the operation is allowed, or until ctx is done or the store fails
+func (l *DistributedWindow) Wait(ctx context.Context) error {
+	return waitStore(ctx, l.clock, l.tryTake)
+}
+
+func (l *DistributedWindow) tryTake(now time.Time) (bool, time.Duration, error) {
+	start := now.UnixNano() / int64(l.window) * int64(l.window)
+	end := time.Unix(0, start).Add(l.window)
+	// Denied operations are counted too, which doesn't matter since the window is full anyway
+	count, err := l.store.Increment(fmt.Sprintf("%s:%d", l.key, start), 1, end.Sub(now))
+	if err != nil {
+		return false, 0, err
+	}
+	if count <= int64(l.limit) {
+		return true, 0, nil
+	}
+	return false, end.Sub(now), nil
+}
+
+// waitStore is wait for limiters whose attempts can fail
+func waitStore(ctx context.Context, clock Clock, try func(now time.Time) (bool, time.Duration, error)) error {
+	return waitNotify(ctx, clock, func(now time.Time) (bool, time.Duration, <-chan struct{}, error) {
+		ok, delay, err := try(now)
+		return ok, delay, nil, err
+	})
+}
+
+// MemoryStore is a Store for limiters within a single process, and the reference
+// for the semantics other stores must follow
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[string]storeEntry
+	sweepAt int // sweep expired entries once there are more entries than this
+	clock   Clock
+}
+
+type storeEntry struct {
+	value   int64
+	expires time.Time
+}
+
+// minSweep is the number of entries below which a store never sweeps
+const minSweep = 64
+
+// NewMemoryStore creates an empty MemoryStore
+func NewMemoryStore(opts ...Option) *MemoryStore {
+	return &MemoryStore{
+		entries: make(map[string]storeEntry),
+		sweepAt: minSweep,
+		clock:   newOptions(opts).clock,
+	}
+}
+
+func (s *MemoryStore) Increment(key string, delta int64, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock.Now()
+	e, ok := s.entries[key]
+	if !ok || !now.Before(e.expires) {
+		e = storeEntry{expires: now.Add(ttl)}
+	}
+	e.value += delta
+	s.set(key, e, now)
+	return e.value, nil
+}
+
+func (s *MemoryStore) Get(key string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.entries[key]; ok && s.clock.Now().Before(e.expires) {
+		return e.value, nil
+	}
+	return 0, nil
+}
+
+func (s *MemoryStore) CompareAndSwap(key string, old, new int64, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock.Now()
+	var current int64
+	if e, ok := s.entries[key]; ok && now.Before(e.expires) {
+		current = e.value
+	}
+	if current != old {
+		return false, nil
+	}
+	s.set(key, storeEntry{value: new, expires: now.Add(ttl)}, now)
+	return true, nil
+}
+
+// set stores e under key, sweeping expired entries once their number doubled since the last sweep
+// so sweeping costs amortized constant time per write
+// Must be called with s.mu held
+func (s *MemoryStore) set(key string, e storeEntry, now time.Time) {
+	s.entries[key] = e
+	if len(s.entries) <= s.sweepAt {
+		return
+	}
+	for k, e := range s.entries {
+		if !now.Before(e.expires) {
+			delete(s.entries, k)
+		}
+	}
+	s.sweepAt = max(2*len(s.entries), minSweep)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// KeyedLimiter keeps a separate token bucket per key, e.g. per tenant or API key
+// Buckets are created on first use and evicted once their key has been idle
+// for the configured period, so memory stays bounded by the number of active keys
+type KeyedLimiter struct {
+	rate  float64
+	burst int
+	idle  time.Duration
+	clock Clock
+
+	mu       sync.Mutex
+	limiters map[string]*keyedEntry
+	stopped  bool
+	cancel   context.CancelFunc
+}
+
+type keyedEntry struct {
+	limiter  *RateLimiter
+	lastSeen time.Time
+}
+
+// NewKeyedLimiter creates a KeyedLimiter whose buckets allow rate operations per second
+// with bursts of up to burst. Keys unused for idle are evicted by a background goroutine
+// until Stop is called. A key is never evicted before its bucket had time to refill,
+// otherwise recreating it would hand out a fresh burst early
+// Rate and burst are validated like in NewTokenBucket
+func NewKeyedLimiter(rate float64, burst int, idle time.Duration, opts ...Option) (*KeyedLimiter, error) {
+	if err := validate(rate, burst); err != nil {
+		return nil, err
+	}
+	if rate > 0 {
+		idle = max(idle, time.Duration(float64(burst)/rate*float64(time.Second)))
+	}
+	if idle <= 0 {
+		idle = time.Minute
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	k := &KeyedLimiter{
+		rate:     rate,
+		burst:    burst,
+		idle:     idle,
+		clock:    newOptions(opts).clock,
+		limiters: make(map[string]*keyedEntry),
+		cancel:   cancel,
+	}
+
+	// The ticker is started here so the eviction schedule starts with the limiter
+	// Its interval is bounded below, idle/2 rounds down to zero for a tiny idle
+	go k.evictIdleKeys(ctx, k.clock.NewTicker(max(idle/2, time.Millisecond)))
+
+	return k, nil
+}
+
+// Allow takes a token for key if one is available and reports whether it did
+func (k *KeyedLimiter) Allow(key string) bool {
+	return k.limiter(key).CanTake()
+}
+
+// Attempt is Allow that also reports the state of the bucket for key
+func (k *KeyedLimiter) Attempt(key string) Status {
+	return k.limiter(key).Attempt()
+}
+
+// Wait blocks until a token for key is available and takes it, or until ctx is done
+func (k *KeyedLimiter) Wait(ctx context.Context, key string) error {
+	return k.limiter(key).Wait(ctx)
+}
+
+// Len returns the number of keys currently tracked
+func (k *KeyedLimiter) Len() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return len(k.limiters)
+}
+
+// Stop stops evicting idle keys and stops every bucket, including ones created afterwards
+func (k *KeyedLimiter) Stop() {
+	k.cancel()
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.stopped = true
+	for _, e := range k.limiters {
+		e.limiter.Stop()
+	}
+}
+
+// limiter returns the bucket for key, creating it if needed
+func (k *KeyedLimiter) limiter(key string) *RateLimiter {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	now := k.clock.Now()
+	e, ok := k.limiters[key]
+	if !ok {
+		e = &keyedEntry{limiter: newTokenBucket(k.rate, k.burst, options{clock: k.clock})}
+		if k.stopped {
+			e.limiter.Stop()
+		}
+		k.limiters[key] = e
+	}
+	e.lastSeen = now
+	return e.limiter
+}
+
+func (k *KeyedLimiter) evictIdleKeys(ctx context.Context, ticker Ticker) {
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			k.mu.Lock()
+			now := k.clock.Now()
+			for key, e := range k.limiters {
+				if now.Sub(e.lastSeen) > k.idle {
+					delete(k.limiters, key)
+				}
+			}
+			k.mu.Unlock()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
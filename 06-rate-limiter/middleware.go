@@ -0,0 +1,61 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// KeyFunc picks the rate limiting key for a request
+type KeyFunc func(r *http.Request) string
+
+// KeyByIP keys requests by the client IP, without the port
+func KeyByIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// KeyByHeader keys requests by the value of header, e.g. an API key
+// Requests without the header are keyed by client IP
+func KeyByHeader(header string) KeyFunc {
+	return func(r *http.Request) string {
+		if v := r.Header.Get(header); v != "" {
+			return header + ":" + v
+		}
+		return KeyByIP(r)
+	}
+}
+
+// Middleware limits requests to next with a bucket per key
+// Every response carries X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset,
+// the last one in seconds until the bucket is full again. Limited requests get
+// 429 Too Many Requests with Retry-After set to the seconds until the next token
+func Middleware(limiter *KeyedLimiter, key KeyFunc) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			status := limiter.Attempt(key(r))
+
+			h := w.Header()
+			h.Set("X-RateLimit-Limit", strconv.Itoa(status.Limit))
+			h.Set("X-RateLimit-Remaining", strconv.Itoa(status.Remaining))
+			h.Set("X-RateLimit-Reset", seconds(status.Reset))
+
+			if !status.Allowed {
+				h.Set("Retry-After", seconds(status.RetryAfter))
+				http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// seconds formats d as whole seconds, rounded up so clients never retry early
+func seconds(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
@@ -3,15 +3,24 @@ package main
 import "time"
 
 type RateLimiter struct {
-	ticker *time.Ticker
+	ticker *time.Ticker // nil when unlimited
 }
 
+// NewRateLimiter creates a limiter allowing n operations per second
+// n <= 0 means unlimited
 func NewRateLimiter(n int) *RateLimiter {
-	limit := time.Second / time.Duration(n)
+	if n <= 0 {
+		return &RateLimiter{}
+	}
+	// Rates above one per nanosecond are capped, a zero interval would panic
+	limit := max(time.Second/time.Duration(n), time.Nanosecond)
 	return &RateLimiter{ticker: time.NewTicker(limit)}
 }
 
 func (r *RateLimiter) CanTake() bool {
+	if r.ticker == nil {
+		return true
+	}
 	select {
 	case <-r.ticker.C:
 		return true
@@ -21,5 +30,15 @@ func (r *RateLimiter) CanTake() bool {
 }
 
 func (r *RateLimiter) Take() {
+	if r.ticker == nil {
+		return
+	}
 	<-r.ticker.C
 }
+
+// Stop releases the ticker, the limiter must not be used afterwards
+func (r *RateLimiter) Stop() {
+	if r.ticker != nil {
+		r.ticker.Stop()
+	}
+}
@@ -0,0 +1,121 @@
+//go:build unix
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"syscall"
+	"time"
+)
+
+// FileStore is a Store kept in a file, so processes on one host can share a quota
+// Every operation locks the whole file with flock, reads it, and writes it back if needed.
+// That is slow compared to a network store, but needs nothing else running
+type FileStore struct {
+	path  string
+	clock Clock
+}
+
+// fileEntry is how a value is kept in the file, expires is in Unix nanoseconds
+type fileEntry struct {
+	Value   int64 `json:"value"`
+	Expires int64 `json:"expires"`
+}
+
+// NewFileStore creates a FileStore backed by path, creating the file if needed
+func NewFileStore(path string, opts ...Option) (*FileStore, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return &FileStore{path: path, clock: newOptions(opts).clock}, nil
+}
+
+func (s *FileStore) Increment(key string, delta int64, ttl time.Duration) (int64, error) {
+	var value int64
+	err := s.update(func(entries map[string]fileEntry, now time.Time) bool {
+		e, ok := entries[key]
+		if !ok {
+			e = fileEntry{Expires: now.Add(ttl).UnixNano()}
+		}
+		e.Value += delta
+		entries[key] = e
+		value = e.Value
+		return true
+	})
+	return value, err
+}
+
+func (s *FileStore) Get(key string) (int64, error) {
+	var value int64
+	err := s.update(func(entries map[string]fileEntry, now time.Time) bool {
+		value = entries[key].Value
+		return false
+	})
+	return value, err
+}
+
+func (s *FileStore) CompareAndSwap(key string, old, new int64, ttl time.Duration) (bool, error) {
+	var swapped bool
+	err := s.update(func(entries map[string]fileEntry, now time.Time) bool {
+		if entries[key].Value != old {
+			return false
+		}
+		entries[key] = fileEntry{Value: new, Expires: now.Add(ttl).UnixNano()}
+		swapped = true
+		return true
+	})
+	return swapped, err
+}
+
+// update runs fn on the unexpired entries with the file locked,
+// and writes them back if fn reports it changed them
+func (s *FileStore) update(fn func(entries map[string]fileEntry, now time.Time) bool) error {
+	f, err := os.OpenFile(s.path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// The lock belongs to this open file, so it also excludes other goroutines of this process
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	entries := make(map[string]fileEntry)
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return err
+		}
+	}
+
+	now := s.clock.Now()
+	for key, e := range entries {
+		if e.Expires <= now.UnixNano() {
+			delete(entries, key)
+		}
+	}
+	if !fn(entries, now) {
+		return nil
+	}
+
+	if data, err = json.Marshal(entries); err != nil {
+		return err
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	// No fsync, the page cache is shared by all processes and the state is not worth keeping across reboots
+	_, err = f.WriteAt(data, 0)
+	return err
+}
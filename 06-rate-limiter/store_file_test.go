@@ -0,0 +1,27 @@
+//go:build unix
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "limits.json")
+	clock := NewFakeClock(epoch)
+	store, err := NewFileStore(path, WithClock(clock))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	testStore(t, store, clock)
+
+	// Another process opening the file sees the same state
+	other, err := NewFileStore(path, WithClock(clock))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if v, err := other.Get("cas"); err != nil || v != 9 {
+		t.Errorf("Expected 9 from a second store on the same file, got %d, %v", v, err)
+	}
+}
@@ -1,28 +1,331 @@
 package main
 
-import "time"
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
 
+// forever is the delay reported when tokens can't become available at the current settings
+const forever = time.Duration(math.MaxInt64)
+
+// epsilon absorbs floating point error, so a token refilled in many small steps
+// is available at exactly the time it is due
+const epsilon = 1e-9
+
+var (
+	// ErrInvalidRate is returned for a rate that is not a number,
+	// or that is not positive for a limiter without an unlimited mode
+	ErrInvalidRate = errors.New("rate limiter: invalid rate")
+	// ErrInvalidBurst is returned for a burst below 1, which would never allow anything
+	ErrInvalidBurst = errors.New("rate limiter: burst must be at least 1")
+	// ErrInvalidLimit is returned for a limit below 1, which would never allow anything
+	ErrInvalidLimit = errors.New("rate limiter: limit must be at least 1")
+	// ErrInvalidWindow is returned for a window that is not positive
+	ErrInvalidWindow = errors.New("rate limiter: window must be positive")
+	// ErrInvalidCapacity is returned for a negative LeakyBucket capacity
+	ErrInvalidCapacity = errors.New("rate limiter: capacity must not be negative")
+	// ErrStopped is returned by Wait once the limiter is stopped
+	ErrStopped = errors.New("rate limiter: stopped")
+)
+
+// RateLimiter is a token bucket
+// The bucket holds up to burst tokens and is refilled at rate tokens per second.
+// Refill is computed lazily from the time elapsed since the last call, so no ticker is needed
+// and capacity left unused while idle is kept, up to burst.
+// A rate <= 0 means unlimited: every operation is allowed right away
 type RateLimiter struct {
-	ticker *time.Ticker
+	mu      sync.Mutex
+	rate    float64 // tokens per second
+	burst   float64
+	tokens  float64
+	last    time.Time
+	clock   Clock
+	changed chan struct{} // closed and replaced by SetRate, SetBurst and Stop to wake waiters
+	stopped bool
+}
+
+// NewRateLimiter creates a limiter allowing n operations per second, one at a time
+// Any n is valid, n <= 0 means unlimited
+func NewRateLimiter(n int, opts ...Option) *RateLimiter {
+	return newTokenBucket(float64(n), 1, newOptions(opts))
 }
 
-func NewRateLimiter(n int) *RateLimiter {
-	opsPerSecond := time.Duration(n)
-	limit := time.Second / opsPerSecond
+// NewTokenBucket creates a limiter refilled at rate tokens per second
+// that allows bursts of up to burst operations. The bucket starts full
+// A rate <= 0 means unlimited, a NaN rate or a burst below 1 is an error
+func NewTokenBucket(rate float64, burst int, opts ...Option) (*RateLimiter, error) {
+	if err := validate(rate, burst); err != nil {
+		return nil, err
+	}
+	return newTokenBucket(rate, burst, newOptions(opts)), nil
+}
+
+func validate(rate float64, burst int) error {
+	if math.IsNaN(rate) {
+		return ErrInvalidRate
+	}
+	if burst < 1 {
+		return ErrInvalidBurst
+	}
+	return nil
+}
+
+func newTokenBucket(rate float64, burst int, o options) *RateLimiter {
 	return &RateLimiter{
-		ticker: time.NewTicker(limit),
+		rate:    rate,
+		burst:   float64(burst),
+		tokens:  float64(burst),
+		last:    o.clock.Now(),
+		clock:   o.clock,
+		changed: make(chan struct{}),
 	}
 }
 
+// CanTake takes a token if one is available and reports whether it did
 func (r *RateLimiter) CanTake() bool {
-	select {
-	case <-r.ticker.C:
-		return true
-	default:
+	return r.CanTakeN(1)
+}
+
+// CanTakeN takes n tokens if they are all available and reports whether it did
+// Use it for weighted operations, e.g. n bytes. It is always false once the limiter is stopped
+func (r *RateLimiter) CanTakeN(n int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stopped {
 		return false
 	}
+	ok, _ := r.tryTake(r.clock.Now(), float64(n))
+	return ok
 }
 
+// Take blocks until a token is available and takes it
+// Once the limiter is stopped no token ever is, so Take blocks forever, use Wait to be told
 func (r *RateLimiter) Take() {
-	<-r.ticker.C
+	r.TakeN(1)
+}
+
+// TakeN blocks until n tokens are available and takes them all at once
+// If n exceeds the burst, TakeN blocks until SetBurst raises it
+func (r *RateLimiter) TakeN(n int) {
+	if r.WaitN(context.Background(), n) == ErrStopped {
+		// Returning would let the caller through unthrottled
+		select {}
+	}
+}
+
+// Wait blocks until a token is available and takes it, or until ctx is done
+// If ctx has a deadline that would pass before a token is available,
+// Wait returns context.DeadlineExceeded right away instead of waiting for it
+// Once the limiter is stopped, Wait returns ErrStopped, waking callers already waiting
+func (r *RateLimiter) Wait(ctx context.Context) error {
+	return r.WaitN(ctx, 1)
+}
+
+// WaitN is Wait for n tokens taken at once
+// Waiting callers re-check immediately when SetRate or SetBurst change the limiter
+func (r *RateLimiter) WaitN(ctx context.Context, n int) error {
+	return waitNotify(ctx, r.clock, func(now time.Time) (bool, time.Duration, <-chan struct{}, error) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		if r.stopped {
+			return false, 0, nil, ErrStopped
+		}
+		ok, delay := r.tryTake(now, float64(n))
+		return ok, delay, r.changed, nil
+	})
+}
+
+// SetRate changes the refill rate, in tokens per second
+// Tokens earned so far are kept, new tokens accrue at the new rate
+// A rate <= 0 makes the limiter unlimited, leaving unlimited mode starts with a full bucket
+func (r *RateLimiter) SetRate(rate float64) error {
+	if math.IsNaN(rate) {
+		return ErrInvalidRate
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.refill(r.clock.Now())
+	r.rate = rate
+	r.notify()
+	return nil
+}
+
+// SetBurst changes the bucket capacity, dropping tokens above it
+func (r *RateLimiter) SetBurst(burst int) error {
+	if burst < 1 {
+		return ErrInvalidBurst
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.refill(r.clock.Now())
+	r.burst = float64(burst)
+	r.tokens = min(r.tokens, r.burst)
+	r.notify()
+	return nil
+}
+
+// Stop makes the limiter deny every operation and wakes callers of Wait with ErrStopped
+// Callers of Take keep blocking. Calling it more than once has no effect
+func (r *RateLimiter) Stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.stopped {
+		r.stopped = true
+		r.notify()
+	}
+}
+
+// Status is the state of a bucket right after Attempt
+type Status struct {
+	Allowed bool
+	// Limit is the burst, the most operations allowed at once
+	Limit int
+	// Remaining is the number of whole tokens left
+	Remaining int
+	// RetryAfter is how long until the next token, zero if the operation was allowed
+	RetryAfter time.Duration
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+}
+
+// Attempt is CanTake that also reports the state of the bucket, e.g. for rate limit headers
+func (r *RateLimiter) Attempt() Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ok, delay := false, forever
+	if !r.stopped {
+		ok, delay = r.tryTake(r.clock.Now(), 1)
+	}
+	status := Status{
+		Allowed:   ok,
+		Limit:     int(r.burst),
+		Remaining: max(int(r.tokens+epsilon), 0),
+		Reset:     r.delay(r.burst),
+	}
+	if !ok {
+		status.RetryAfter = delay
+	}
+	return status
+}
+
+// notify wakes every caller waiting for tokens
+// Must be called with r.mu held
+func (r *RateLimiter) notify() {
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// tryTake takes n tokens if available, otherwise returns how long until they are
+// Must be called with r.mu held
+func (r *RateLimiter) tryTake(now time.Time, n float64) (bool, time.Duration) {
+	r.refill(now)
+	if r.unlimited() {
+		return true, 0
+	}
+	if r.tokens+epsilon >= n {
+		r.tokens -= n
+		return true, 0
+	}
+	return false, r.delay(n)
+}
+
+// Reservation is a token taken ahead of time by Reserve
+type Reservation struct {
+	limiter  *RateLimiter
+	made     time.Time
+	delay    time.Duration
+	taken    bool // whether a token was debited, only then Cancel returns one
+	canceled bool
+}
+
+// Reserve takes a token immediately, even if the bucket has to go into debt for it,
+// and returns a Reservation telling when the caller may act
+// Operations that then don't happen must return the token with Cancel
+// Once the limiter is stopped, reservations never become due
+func (r *RateLimiter) Reserve() *Reservation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.clock.Now()
+	r.refill(now)
+	res := &Reservation{limiter: r, made: now}
+	switch {
+	case r.stopped:
+		res.delay = forever
+	case !r.unlimited():
+		res.delay = r.delay(1)
+		r.tokens--
+		res.taken = true
+	}
+	return res
+}
+
+// Delay returns how long the caller has to wait before acting on the reservation
+func (res *Reservation) Delay() time.Duration {
+	return max(res.delay-res.limiter.clock.Now().Sub(res.made), 0)
+}
+
+// Cancel returns the reserved token to the limiter
+// It has no effect once the reservation is due, the caller may have acted on it already,
+// or if no token was taken, e.g. after Stop. Calling it more than once has no effect
+func (res *Reservation) Cancel() {
+	r := res.limiter
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.clock.Now()
+	if res.canceled || !res.taken || now.Sub(res.made) >= res.delay {
+		return
+	}
+	res.canceled = true
+	r.refill(now)
+	r.tokens = min(r.burst, r.tokens+1)
+}
+
+// refill adds the tokens earned since the last refill
+// tokens go below zero while reservations are in debt, and stay at burst while unlimited
+// Must be called with r.mu held
+func (r *RateLimiter) refill(now time.Time) {
+	if r.unlimited() {
+		r.tokens = r.burst
+	} else if elapsed := now.Sub(r.last); elapsed > 0 {
+		r.tokens = min(r.burst, r.tokens+elapsed.Seconds()*r.rate)
+	}
+	if now.After(r.last) {
+		r.last = now
+	}
+}
+
+// unlimited reports whether every operation is allowed
+// Must be called with r.mu held
+func (r *RateLimiter) unlimited() bool {
+	return r.rate <= 0
+}
+
+// delay returns how long it takes until the bucket holds n tokens
+// It is forever if n exceeds the burst
+// Must be called with r.mu held
+func (r *RateLimiter) delay(n float64) time.Duration {
+	if r.tokens+epsilon >= n {
+		return 0
+	}
+	if n > r.burst {
+		return forever
+	}
+	seconds := (n - r.tokens) / r.rate
+	if seconds >= forever.Seconds() {
+		return forever
+	}
+	return time.Duration(seconds * float64(time.Second))
 }
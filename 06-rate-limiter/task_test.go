@@ -1,56 +1,107 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
+// epoch is where fake clocks start, any fixed time works
+var epoch = time.Unix(1_700_000_000, 0)
+
+// finished reports whether done is closed, giving a goroutine woken by the fake clock time to run
+func finished(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	case <-time.After(100 * time.Millisecond):
+		return false
+	}
+}
+
+func mustTokenBucket(t *testing.T, rate float64, burst int, opts ...Option) *RateLimiter {
+	t.Helper()
+
+	limiter, err := NewTokenBucket(rate, burst, opts...)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return limiter
+}
+
+func mustKeyedLimiter(t *testing.T, rate float64, burst int, idle time.Duration, opts ...Option) *KeyedLimiter {
+	t.Helper()
+
+	limiter, err := NewKeyedLimiter(rate, burst, idle, opts...)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return limiter
+}
+
+func mustDistributedBucket(t *testing.T, store Store, key string, rate float64, burst int, opts ...Option) *DistributedBucket {
+	t.Helper()
+
+	limiter, err := NewDistributedBucket(store, key, rate, burst, opts...)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return limiter
+}
+
+func mustDistributedWindow(t *testing.T, store Store, key string, limit int, window time.Duration, opts ...Option) *DistributedWindow {
+	t.Helper()
+
+	limiter, err := NewDistributedWindow(store, key, limit, window, opts...)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return limiter
+}
+
 func TestCanTake(t *testing.T) {
 	tests := []struct {
 		name     string
 		duration time.Duration
 		rps      int
-		min      int
-		max      int
+		want     int
 	}{
 		{
 			name:     "100 RPS for 1 second",
 			duration: 1 * time.Second,
 			rps:      100,
-			min:      95,
-			max:      105, // Allow some flexibility
+			want:     100,
 		},
 		{
 			name:     "100 RPS for 500ms",
 			duration: 500 * time.Millisecond,
 			rps:      100,
-			min:      45, // ~50 requests expected (100 RPS * 0.5s)
-			max:      55, // Allow some flexibility
+			want:     50,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			limiter := NewRateLimiter(tt.rps)
-			timer := time.NewTimer(tt.duration)
-			var total int
-			for loop := true; loop; {
-				if total > tt.max {
-					break
-				}
+			clock := NewFakeClock(epoch)
+			limiter := NewRateLimiter(tt.rps, WithClock(clock))
 
-				select {
-				case <-timer.C:
-					loop = false
-				default:
-				}
+			// Poll every millisecond, far more often than tokens arrive
+			var total int
+			for elapsed := time.Duration(0); elapsed < tt.duration; elapsed += time.Millisecond {
 				if limiter.CanTake() {
 					total++
 				}
+				clock.Advance(time.Millisecond)
 			}
 
-			if total < tt.min || total > tt.max {
-				t.Errorf("failed rps. expeceted between %d and %d, got: %d", tt.min, tt.max, total)
+			if total != tt.want {
+				t.Errorf("failed rps. expected %d, got: %d", tt.want, total)
 			}
 		})
 	}
@@ -61,47 +112,859 @@ func TestTake(t *testing.T) {
 		name     string
 		duration time.Duration
 		rps      int
-		min      int
-		max      int
+		want     int
 	}{
 		{
 			name:     "100 RPS for 1 second",
 			duration: 1 * time.Second,
 			rps:      100,
-			min:      95,
-			max:      105, // Allow some flexibility
+			want:     100,
 		},
 		{
 			name:     "100 RPS for 500ms",
 			duration: 500 * time.Millisecond,
 			rps:      100,
-			min:      45, // ~50 requests expected (100 RPS * 0.5s)
-			max:      55, // Allow some flexibility
+			want:     50,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			limiter := NewRateLimiter(tt.rps)
-			timer := time.NewTimer(tt.duration)
-			var total int
-			for loop := true; loop; {
-				if total > tt.max {
-					break
+			clock := NewFakeClock(epoch)
+			limiter := NewRateLimiter(tt.rps, WithClock(clock))
+
+			var total atomic.Int32
+			var stop atomic.Bool
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for !stop.Load() {
+					limiter.Take()
+					total.Add(1)
+				}
+			}()
+
+			// Step up to the last millisecond before duration, each time once Take is waiting
+			for elapsed := time.Millisecond; elapsed < tt.duration; elapsed += time.Millisecond {
+				clock.BlockUntil(1)
+				clock.Advance(time.Millisecond)
+			}
+			clock.BlockUntil(1)
+
+			if got := int(total.Load()); got != tt.want {
+				t.Errorf("failed rps. expected %d, got: %d", tt.want, got)
+			}
+
+			stop.Store(true)
+			clock.Advance(time.Second)
+			<-done
+		})
+	}
+}
+
+func TestTokenBucketBurst(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	limiter := mustTokenBucket(t, 20, 5, WithClock(clock))
+
+	for i := range 5 {
+		if !limiter.CanTake() {
+			t.Fatalf("Token %d of the initial burst was not available", i+1)
+		}
+	}
+	if limiter.CanTake() {
+		t.Error("Bucket should be empty after the burst")
+	}
+
+	// Unused capacity accrues while idle, but never beyond the burst
+	clock.Advance(100 * time.Millisecond)
+	if !limiter.CanTake() || !limiter.CanTake() {
+		t.Error("Tokens should be refilled while idle")
+	}
+	if limiter.CanTake() {
+		t.Error("Only 2 tokens should be refilled in 100ms")
+	}
+
+	clock.Advance(time.Second)
+	var total int
+	for limiter.CanTake() {
+		total++
+	}
+	if total != 5 {
+		t.Errorf("Expected refill to stop at burst 5, got %d tokens", total)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		limiter.Take()
+		close(done)
+	}()
+	clock.BlockUntil(1)
+	clock.Advance(49 * time.Millisecond)
+	if finished(done) {
+		t.Error("Take on an empty bucket should wait 50ms, returned after 49ms")
+	}
+	clock.Advance(time.Millisecond)
+	if !finished(done) {
+		t.Error("Take on an empty bucket should return after 50ms")
+	}
+}
+
+func TestWait(t *testing.T) {
+	limiter := mustTokenBucket(t, 10, 1)
+
+	if err := limiter.Wait(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Next token is 100ms away, past the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := limiter.Wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected context.DeadlineExceeded, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Errorf("Wait should fail fast when the deadline can't be met, took %v", elapsed)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if err := limiter.Wait(ctx); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got: %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := limiter.Wait(ctx); err != nil {
+		t.Errorf("Wait should succeed before the deadline, got: %v", err)
+	}
+}
+
+func TestReserve(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	limiter := mustTokenBucket(t, 10, 1, WithClock(clock))
+
+	first := limiter.Reserve()
+	if first.Delay() != 0 {
+		t.Errorf("First reservation should not wait, got %v", first.Delay())
+	}
+
+	second := limiter.Reserve()
+	if delay := second.Delay(); delay != 100*time.Millisecond {
+		t.Errorf("Second reservation should wait 100ms, got %v", delay)
+	}
+	third := limiter.Reserve()
+	if delay := third.Delay(); delay != 200*time.Millisecond {
+		t.Errorf("Third reservation should wait 200ms, got %v", delay)
+	}
+
+	clock.Advance(50 * time.Millisecond)
+	if delay := second.Delay(); delay != 50*time.Millisecond {
+		t.Errorf("Delay should count down with the clock, got %v", delay)
+	}
+
+	third.Cancel()
+	second.Cancel()
+	second.Cancel()
+	fourth := limiter.Reserve()
+	if delay := fourth.Delay(); delay != 50*time.Millisecond {
+		t.Errorf("Canceled reservations should return their tokens, got delay %v", delay)
+	}
+
+	clock.Advance(50 * time.Millisecond)
+	fourth.Cancel()
+	if delay := limiter.Reserve().Delay(); delay != 100*time.Millisecond {
+		t.Errorf("Canceling a due reservation should not return its token, got delay %v", delay)
+	}
+
+	stopped := mustTokenBucket(t, 10, 1, WithClock(clock))
+	stopped.CanTake()
+	stopped.Stop()
+	stopped.Reserve().Cancel()
+	if remaining := stopped.Attempt().Remaining; remaining != 0 {
+		t.Errorf("Canceling a reservation that took nothing should not add tokens, got %d", remaining)
+	}
+}
+
+func TestTakeN(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	limiter := mustTokenBucket(t, 100, 10, WithClock(clock))
+
+	if !limiter.CanTakeN(6) {
+		t.Error("Should take 6 of 10 tokens")
+	}
+	if limiter.CanTakeN(5) {
+		t.Error("Should not take 5 tokens with 4 left")
+	}
+	if !limiter.CanTakeN(4) {
+		t.Error("A failed CanTakeN should not consume tokens")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		limiter.TakeN(5)
+		close(done)
+	}()
+	clock.BlockUntil(1)
+	clock.Advance(49 * time.Millisecond)
+	if finished(done) {
+		t.Error("TakeN(5) at 100/s should wait 50ms, returned after 49ms")
+	}
+	clock.Advance(time.Millisecond)
+	if !finished(done) {
+		t.Error("TakeN(5) at 100/s should return after 50ms")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	if err := limiter.WaitN(ctx, 11); err != context.DeadlineExceeded {
+		t.Errorf("WaitN above the burst should fail fast with a deadline, got %v", err)
+	}
+}
+
+func TestSetRate(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	limiter := mustTokenBucket(t, 1, 1, WithClock(clock))
+	limiter.Take()
+
+	done := make(chan struct{})
+	go func() {
+		limiter.Take()
+		close(done)
+	}()
+
+	clock.BlockUntil(1)
+	limiter.SetRate(100)
+	clock.Advance(9 * time.Millisecond)
+	if finished(done) {
+		t.Error("Take should wait 10ms at the new rate, returned after 9ms")
+	}
+	clock.Advance(time.Millisecond)
+	if !finished(done) {
+		t.Fatal("A waiting Take should speed up after SetRate")
+	}
+}
+
+func TestSetBurst(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	limiter := mustTokenBucket(t, 1000, 2, WithClock(clock))
+
+	done := make(chan struct{})
+	go func() {
+		limiter.TakeN(5)
+		close(done)
+	}()
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	if finished(done) {
+		t.Fatal("TakeN above the burst should block")
+	}
+
+	limiter.SetBurst(5)
+	clock.Advance(3 * time.Millisecond)
+	if !finished(done) {
+		t.Fatal("TakeN should proceed once SetBurst raises the burst")
+	}
+
+	limiter.SetBurst(1)
+	clock.Advance(time.Second)
+	if limiter.CanTakeN(2) {
+		t.Error("Tokens should be capped to the lowered burst")
+	}
+	if !limiter.CanTake() {
+		t.Error("A token should be left after lowering the burst")
+	}
+}
+
+func TestNewTokenBucketValidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		rate  float64
+		burst int
+		idle  time.Duration // of the keyed limiter, a minute if zero
+		err   error
+	}{
+		{name: "valid", rate: 10, burst: 1},
+		{name: "unlimited", rate: 0, burst: 1},
+		{name: "negative rate is unlimited", rate: -1, burst: 1},
+		{name: "NaN rate", rate: math.NaN(), burst: 1, err: ErrInvalidRate},
+		{name: "zero burst", rate: 10, burst: 0, err: ErrInvalidBurst},
+		{name: "unlimited with a tiny idle", rate: 0, burst: 1, idle: time.Nanosecond},
+		{name: "refill within a nanosecond", rate: 1e9, burst: 1, idle: time.Nanosecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewTokenBucket(tt.rate, tt.burst); err != tt.err {
+				t.Errorf("Expected %v, got %v", tt.err, err)
+			}
+			idle := tt.idle
+			if idle == 0 {
+				idle = time.Minute
+			}
+			keyed, err := NewKeyedLimiter(tt.rate, tt.burst, idle)
+			if err != tt.err {
+				t.Errorf("NewKeyedLimiter: expected %v, got %v", tt.err, err)
+			}
+			if keyed != nil {
+				keyed.Stop()
+			}
+		})
+	}
+
+	limiter := mustTokenBucket(t, 10, 1)
+	if err := limiter.SetRate(math.NaN()); err != ErrInvalidRate {
+		t.Errorf("SetRate(NaN): expected ErrInvalidRate, got %v", err)
+	}
+	if err := limiter.SetBurst(0); err != ErrInvalidBurst {
+		t.Errorf("SetBurst(0): expected ErrInvalidBurst, got %v", err)
+	}
+}
+
+func TestUnlimited(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	limiter := NewRateLimiter(0, WithClock(clock))
+
+	for i := range 1000 {
+		if !limiter.CanTake() {
+			t.Fatalf("Unlimited limiter denied operation %d", i+1)
+		}
+	}
+	limiter.Take()
+	if err := limiter.WaitN(context.Background(), 100); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if delay := limiter.Reserve().Delay(); delay != 0 {
+		t.Errorf("Unlimited reservations should not wait, got %v", delay)
+	}
+
+	// Leaving unlimited mode starts with a full bucket
+	limiter.SetRate(10)
+	if !limiter.CanTake() || limiter.CanTake() {
+		t.Error("Expected exactly the burst after leaving unlimited mode")
+	}
+	limiter.SetRate(-1)
+	if !limiter.CanTake() {
+		t.Error("SetRate(-1) should make the limiter unlimited")
+	}
+}
+
+func TestStop(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	limiter := NewRateLimiter(1, WithClock(clock))
+	limiter.Take()
+
+	errs := make(chan error)
+	go func() {
+		errs <- limiter.Wait(context.Background())
+	}()
+	clock.BlockUntil(1)
+
+	limiter.Stop()
+	limiter.Stop()
+	select {
+	case err := <-errs:
+		if err != ErrStopped {
+			t.Errorf("Expected ErrStopped, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Stop should wake waiting callers")
+	}
+
+	clock.Advance(time.Hour)
+	if limiter.CanTake() {
+		t.Error("A stopped limiter should deny operations")
+	}
+	if err := limiter.Wait(context.Background()); err != ErrStopped {
+		t.Errorf("Expected ErrStopped, got %v", err)
+	}
+	taken := make(chan struct{})
+	go func() {
+		limiter.Take()
+		close(taken)
+	}()
+	if finished(taken) {
+		t.Error("Take on a stopped limiter should never let the caller through")
+	}
+
+	keyed := mustKeyedLimiter(t, 1, 1, time.Minute, WithClock(clock))
+	if !keyed.Allow("before") {
+		t.Error("Keyed limiter should allow before Stop")
+	}
+	keyed.Stop()
+	clock.Advance(time.Hour)
+	if keyed.Allow("before") || keyed.Allow("after") {
+		t.Error("Every bucket of a stopped keyed limiter should deny operations")
+	}
+}
+
+func TestKeyedLimiter(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	limiter := mustKeyedLimiter(t, 100, 2, 50*time.Millisecond, WithClock(clock))
+	defer limiter.Stop()
+
+	for _, key := range []string{"tenant-a", "tenant-b"} {
+		if !limiter.Allow(key) || !limiter.Allow(key) {
+			t.Errorf("Burst for %s should be allowed", key)
+		}
+		if limiter.Allow(key) {
+			t.Errorf("Third call for %s should be limited", key)
+		}
+	}
+
+	clock.Advance(10 * time.Millisecond)
+	if !limiter.Allow("tenant-a") {
+		t.Error("Token for tenant-a should be refilled after 10ms")
+	}
+
+	if limiter.Len() != 2 {
+		t.Errorf("Expected 2 keys, got %d", limiter.Len())
+	}
+
+	// Eviction runs on its own goroutine, so give it time to handle the ticks
+	clock.Advance(100 * time.Millisecond)
+	for deadline := time.Now().Add(time.Second); limiter.Len() != 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if limiter.Len() != 0 {
+		t.Errorf("Idle keys should be evicted, got %d", limiter.Len())
+	}
+}
+
+func TestKeyedLimiterConcurrent(t *testing.T) {
+	limiter := mustKeyedLimiter(t, 1, 10, time.Minute)
+	defer limiter.Stop()
+
+	var allowed [4]atomic.Int32
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 100 {
+				key := j % len(allowed)
+				if limiter.Allow(fmt.Sprintf("key-%d", key)) {
+					allowed[key].Add(1)
 				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for key := range allowed {
+		if n := allowed[key].Load(); n != 10 {
+			t.Errorf("Expected exactly the burst of 10 for key-%d, got %d", key, n)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	limiter := mustKeyedLimiter(t, 2, 4, time.Minute, WithClock(clock))
+	defer limiter.Stop()
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	type want struct {
+		code                    int
+		remaining, reset, retry string
+	}
+	tests := []struct {
+		name    string
+		key     KeyFunc
+		request func() *http.Request
+		wants   []want
+	}{
+		{
+			name: "by ip",
+			key:  KeyByIP,
+			request: func() *http.Request {
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				r.RemoteAddr = "10.0.0.1:5555"
+				return r
+			},
+			wants: []want{
+				{code: http.StatusNoContent, remaining: "3", reset: "1"},
+				{code: http.StatusNoContent, remaining: "2", reset: "1"},
+				{code: http.StatusNoContent, remaining: "1", reset: "2"},
+				{code: http.StatusNoContent, remaining: "0", reset: "2"},
+				{code: http.StatusTooManyRequests, remaining: "0", reset: "2", retry: "1"},
+			},
+		},
+		{
+			name: "by header",
+			key:  KeyByHeader("X-API-Key"),
+			request: func() *http.Request {
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				r.RemoteAddr = "10.0.0.1:5555" // same IP as above, but its own bucket
+				r.Header.Set("X-API-Key", "tenant-a")
+				return r
+			},
+			wants: []want{
+				{code: http.StatusNoContent, remaining: "3", reset: "1"},
+				{code: http.StatusNoContent, remaining: "2", reset: "1"},
+				{code: http.StatusNoContent, remaining: "1", reset: "2"},
+				{code: http.StatusNoContent, remaining: "0", reset: "2"},
+				{code: http.StatusTooManyRequests, remaining: "0", reset: "2", retry: "1"},
+			},
+		},
+	}
 
-				select {
-				case <-timer.C:
-					loop = false
-				default:
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := Middleware(limiter, tt.key)(ok)
+			for i, w := range tt.wants {
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, tt.request())
+
+				if rec.Code != w.code {
+					t.Errorf("Request %d: expected status %d, got %d", i+1, w.code, rec.Code)
+				}
+				h := rec.Header()
+				if got := h.Get("X-RateLimit-Limit"); got != "4" {
+					t.Errorf("Request %d: expected X-RateLimit-Limit 4, got %q", i+1, got)
+				}
+				if got := h.Get("X-RateLimit-Remaining"); got != w.remaining {
+					t.Errorf("Request %d: expected X-RateLimit-Remaining %s, got %q", i+1, w.remaining, got)
+				}
+				if got := h.Get("X-RateLimit-Reset"); got != w.reset {
+					t.Errorf("Request %d: expected X-RateLimit-Reset %s, got %q", i+1, w.reset, got)
+				}
+				if got := h.Get("Retry-After"); got != w.retry {
+					t.Errorf("Request %d: expected Retry-After %q, got %q", i+1, w.retry, got)
 				}
-				limiter.Take()
-				total++
 			}
+		})
+	}
+
+	// Another client has its own bucket, and limited clients recover once a token is refilled
+	other := httptest.NewRequest(http.MethodGet, "/", nil)
+	other.RemoteAddr = "10.0.0.2:5555"
+	rec := httptest.NewRecorder()
+	Middleware(limiter, KeyByIP)(ok).ServeHTTP(rec, other)
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("Another IP should not be limited, got status %d", rec.Code)
+	}
+
+	clock.Advance(500 * time.Millisecond)
+	limited := httptest.NewRequest(http.MethodGet, "/", nil)
+	limited.RemoteAddr = "10.0.0.1:6666"
+	rec = httptest.NewRecorder()
+	Middleware(limiter, KeyByIP)(ok).ServeHTTP(rec, limited)
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("Limited IP should be allowed once a token is refilled, got status %d", rec.Code)
+	}
+}
+
+// testStore checks the semantics every Store must follow
+// It advances clock, which store must be using
+func testStore(t *testing.T, store Store, clock *FakeClock) {
+	t.Helper()
+
+	if v, err := store.Increment("count", 2, time.Second); err != nil || v != 2 {
+		t.Errorf("Increment of a missing key: expected 2, got %d, %v", v, err)
+	}
+	clock.Advance(600 * time.Millisecond)
+	if v, err := store.Increment("count", 3, time.Second); err != nil || v != 5 {
+		t.Errorf("Increment of an existing key: expected 5, got %d, %v", v, err)
+	}
+	clock.Advance(400 * time.Millisecond)
+	if v, err := store.Get("count"); err != nil || v != 0 {
+		t.Errorf("Increment should keep the first expiry, expected 0 after it, got %d, %v", v, err)
+	}
+	if v, err := store.Increment("count", 1, time.Second); err != nil || v != 1 {
+		t.Errorf("Increment of an expired key: expected 1, got %d, %v", v, err)
+	}
 
-			if total < tt.min || total > tt.max {
-				t.Errorf("failed rps. expeceted between %d and %d, got: %d", tt.min, tt.max, total)
+	if ok, err := store.CompareAndSwap("cas", 0, 7, time.Second); err != nil || !ok {
+		t.Errorf("CompareAndSwap of a missing key from 0 should succeed, got %v, %v", ok, err)
+	}
+	if ok, err := store.CompareAndSwap("cas", 0, 8, time.Second); err != nil || ok {
+		t.Errorf("CompareAndSwap with a stale value should fail, got %v, %v", ok, err)
+	}
+	if v, err := store.Get("cas"); err != nil || v != 7 {
+		t.Errorf("Expected 7, got %d, %v", v, err)
+	}
+	clock.Advance(time.Second)
+	if ok, err := store.CompareAndSwap("cas", 0, 9, time.Second); err != nil || !ok {
+		t.Errorf("CompareAndSwap of an expired key from 0 should succeed, got %v, %v", ok, err)
+	}
+
+	// Replicas sharing the store share the quota
+	replicas := []Limiter{
+		mustDistributedBucket(t, store, "bucket", 10, 5, WithClock(clock)),
+		mustDistributedBucket(t, store, "bucket", 10, 5, WithClock(clock)),
+		mustDistributedWindow(t, store, "window", 5, time.Second, WithClock(clock)),
+		mustDistributedWindow(t, store, "window", 5, time.Second, WithClock(clock)),
+	}
+	for i := 0; i < len(replicas); i += 2 {
+		var allowed atomic.Int32
+		var wg sync.WaitGroup
+		for _, limiter := range replicas[i : i+2] {
+			for range 4 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for range 5 {
+						if limiter.CanTake() {
+							allowed.Add(1)
+						}
+					}
+				}()
+			}
+		}
+		wg.Wait()
+		if n := allowed.Load(); n != 5 {
+			t.Errorf("Replica pair %d: expected exactly 5 allowed, got %d", i/2, n)
+		}
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	testStore(t, NewMemoryStore(WithClock(clock)), clock)
+}
+
+func TestDistributedLimiters(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	store := NewMemoryStore(WithClock(clock))
+	bucket := mustDistributedBucket(t, store, "bucket", 10, 2, WithClock(clock))
+	window := mustDistributedWindow(t, store, "window", 2, time.Second, WithClock(clock))
+
+	for _, limiter := range []Limiter{bucket, window} {
+		if !limiter.CanTake() || !limiter.CanTake() {
+			t.Errorf("%T: burst should be allowed", limiter)
+		}
+		if limiter.CanTake() {
+			t.Errorf("%T: third call should be limited", limiter)
+		}
+	}
+
+	clock.Advance(100 * time.Millisecond)
+	if !bucket.CanTake() || bucket.CanTake() {
+		t.Error("Bucket should refill one token in 100ms")
+	}
+	if window.CanTake() {
+		t.Error("Window should stay limited until it ends")
+	}
+	clock.Advance(900 * time.Millisecond)
+	if !window.CanTake() {
+		t.Error("Next window should be allowed")
+	}
+
+	// Drain the bucket so Wait has to wait for the clock
+	for bucket.CanTake() {
+	}
+	done := make(chan error)
+	go func() {
+		done <- bucket.Wait(context.Background())
+	}()
+	clock.BlockUntil(1)
+	clock.Advance(100 * time.Millisecond)
+	if err := <-done; err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// Windows past expiry are swept from the store
+	for range 2 * minSweep {
+		clock.Advance(time.Second)
+		window.CanTake()
+	}
+	store.mu.Lock()
+	n := len(store.entries)
+	store.mu.Unlock()
+	if n > 2*minSweep {
+		t.Errorf("Expired windows should be swept, store holds %d entries", n)
+	}
+}
+
+func TestDistributedValidation(t *testing.T) {
+	store := NewMemoryStore()
+	tests := []struct {
+		name    string
+		limiter func() (Limiter, error)
+		err     error
+	}{
+		{name: "bucket zero rate", limiter: func() (Limiter, error) { return NewDistributedBucket(store, "k", 0, 1) }, err: ErrInvalidRate},
+		{name: "bucket negative rate", limiter: func() (Limiter, error) { return NewDistributedBucket(store, "k", -1, 1) }, err: ErrInvalidRate},
+		{name: "bucket NaN rate", limiter: func() (Limiter, error) { return NewDistributedBucket(store, "k", math.NaN(), 1) }, err: ErrInvalidRate},
+		{name: "bucket zero burst", limiter: func() (Limiter, error) { return NewDistributedBucket(store, "k", 1, 0) }, err: ErrInvalidBurst},
+		{name: "window zero limit", limiter: func() (Limiter, error) { return NewDistributedWindow(store, "k", 0, time.Second) }, err: ErrInvalidLimit},
+		{name: "window zero window", limiter: func() (Limiter, error) { return NewDistributedWindow(store, "k", 1, 0) }, err: ErrInvalidWindow},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.limiter(); err != tt.err {
+				t.Errorf("Expected %v, got %v", tt.err, err)
 			}
 		})
 	}
 }
+
+func TestLimiterAlgorithms(t *testing.T) {
+	type step struct {
+		at      time.Duration // since the limiter was created
+		takes   int
+		allowed int
+	}
+
+	tests := []struct {
+		name    string
+		limiter func(clock Clock) (Limiter, error)
+		steps   []step
+	}{
+		{
+			name: "fixed window allows a double burst around the boundary",
+			limiter: func(clock Clock) (Limiter, error) {
+				return NewFixedWindow(10, time.Second, WithClock(clock))
+			},
+			steps: []step{
+				{at: 900 * time.Millisecond, takes: 15, allowed: 10},
+				{at: 1000 * time.Millisecond, takes: 15, allowed: 10},
+				{at: 1999 * time.Millisecond, takes: 1, allowed: 0},
+				{at: 2000 * time.Millisecond, takes: 1, allowed: 1},
+			},
+		},
+		{
+			name: "sliding window log is exact across the boundary",
+			limiter: func(clock Clock) (Limiter, error) {
+				return NewSlidingWindowLog(10, time.Second, WithClock(clock))
+			},
+			steps: []step{
+				{at: 900 * time.Millisecond, takes: 15, allowed: 10},
+				{at: 1000 * time.Millisecond, takes: 15, allowed: 0},
+				{at: 1899 * time.Millisecond, takes: 1, allowed: 0},
+				{at: 1900 * time.Millisecond, takes: 15, allowed: 10},
+			},
+		},
+		{
+			name: "sliding window counter weights the previous window",
+			limiter: func(clock Clock) (Limiter, error) {
+				return NewSlidingWindowCounter(10, time.Second, WithClock(clock))
+			},
+			steps: []step{
+				{at: 900 * time.Millisecond, takes: 15, allowed: 10},
+				{at: 1000 * time.Millisecond, takes: 15, allowed: 0},
+				{at: 1500 * time.Millisecond, takes: 15, allowed: 5},
+				{at: 3000 * time.Millisecond, takes: 15, allowed: 10},
+			},
+		},
+		{
+			name: "token bucket refills gradually after a burst",
+			limiter: func(clock Clock) (Limiter, error) {
+				return NewTokenBucket(10, 10, WithClock(clock))
+			},
+			steps: []step{
+				{at: 900 * time.Millisecond, takes: 15, allowed: 10},
+				{at: 1000 * time.Millisecond, takes: 15, allowed: 1},
+				{at: 1500 * time.Millisecond, takes: 15, allowed: 5},
+				{at: 5000 * time.Millisecond, takes: 15, allowed: 10},
+			},
+		},
+		{
+			name: "leaky bucket never bursts",
+			limiter: func(clock Clock) (Limiter, error) {
+				return NewLeakyBucket(10, 10, WithClock(clock))
+			},
+			steps: []step{
+				{at: 900 * time.Millisecond, takes: 15, allowed: 1},
+				{at: 1000 * time.Millisecond, takes: 15, allowed: 1},
+				{at: 1050 * time.Millisecond, takes: 15, allowed: 0},
+				{at: 5000 * time.Millisecond, takes: 15, allowed: 1},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := NewFakeClock(epoch)
+			limiter, err := tt.limiter(clock)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			for _, s := range tt.steps {
+				clock.Advance(epoch.Add(s.at).Sub(clock.Now()))
+				var allowed int
+				for range s.takes {
+					if limiter.CanTake() {
+						allowed++
+					}
+				}
+				if allowed != s.allowed {
+					t.Errorf("At %v: expected %d allowed, got %d", s.at, s.allowed, allowed)
+				}
+			}
+		})
+	}
+}
+
+func TestLimiterAlgorithmsValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		limiter func() (Limiter, error)
+		err     error
+	}{
+		{name: "fixed window zero limit", limiter: func() (Limiter, error) { return NewFixedWindow(0, time.Second) }, err: ErrInvalidLimit},
+		{name: "fixed window zero window", limiter: func() (Limiter, error) { return NewFixedWindow(1, 0) }, err: ErrInvalidWindow},
+		{name: "sliding log zero limit", limiter: func() (Limiter, error) { return NewSlidingWindowLog(0, time.Second) }, err: ErrInvalidLimit},
+		{name: "sliding log negative window", limiter: func() (Limiter, error) { return NewSlidingWindowLog(1, -time.Second) }, err: ErrInvalidWindow},
+		{name: "sliding counter zero limit", limiter: func() (Limiter, error) { return NewSlidingWindowCounter(0, time.Second) }, err: ErrInvalidLimit},
+		{name: "sliding counter zero window", limiter: func() (Limiter, error) { return NewSlidingWindowCounter(1, 0) }, err: ErrInvalidWindow},
+		{name: "leaky bucket zero rate", limiter: func() (Limiter, error) { return NewLeakyBucket(0, 1) }, err: ErrInvalidRate},
+		{name: "leaky bucket NaN rate", limiter: func() (Limiter, error) { return NewLeakyBucket(math.NaN(), 1) }, err: ErrInvalidRate},
+		{name: "leaky bucket rate too low", limiter: func() (Limiter, error) { return NewLeakyBucket(1e-12, 1) }, err: ErrInvalidRate},
+		{name: "leaky bucket negative capacity", limiter: func() (Limiter, error) { return NewLeakyBucket(1, -1) }, err: ErrInvalidCapacity},
+		{name: "leaky bucket zero capacity", limiter: func() (Limiter, error) { return NewLeakyBucket(1, 0) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.limiter(); err != tt.err {
+				t.Errorf("Expected %v, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestLeakyBucketQueue(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	limiter, err := NewLeakyBucket(100, 2, WithClock(clock))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ctx := context.Background()
+
+	if err := limiter.Wait(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The next two slots are 10ms and 20ms away, which fills the queue
+	done := make(chan struct{}, 2)
+	for range 2 {
+		go func() {
+			if err := limiter.Wait(ctx); err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			done <- struct{}{}
+		}()
+	}
+	clock.BlockUntil(2)
+	if err := limiter.Wait(ctx); err != ErrBucketFull {
+		t.Errorf("Expected ErrBucketFull, got %v", err)
+	}
+
+	clock.Advance(10 * time.Millisecond)
+	<-done
+	select {
+	case <-done:
+		t.Error("Operations should be spaced 10ms apart")
+	case <-time.After(100 * time.Millisecond):
+	}
+	clock.Advance(10 * time.Millisecond)
+	<-done
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the source of time used by the cache
+// The default is the system clock, tests use a FakeClock to step time exactly
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is the part of time.Timer the cache uses
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// Option configures a TtlCache
+type Option func(*options)
+
+type options struct {
+	clock Clock
+}
+
+// WithClock makes the cache read time from clock instead of the system clock
+func WithClock(clock Clock) Option {
+	return func(o *options) {
+		o.clock = clock
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := options{clock: systemClock{}}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// systemClock is the Clock backed by package time
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+type systemTimer struct{ *time.Timer }
+
+func (t systemTimer) C() <-chan time.Time { return t.Timer.C }
+
+// FakeClock is a Clock that only moves when advanced
+// Timers fire synchronously inside Advance, in the order they are due
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*fakeTimer
+	armed   *sync.Cond // broadcast whenever a timer is armed
+}
+
+// NewFakeClock creates a FakeClock set to now
+func NewFakeClock(now time.Time) *FakeClock {
+	c := &FakeClock{now: now}
+	c.armed = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *FakeClock) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &fakeTimer{clock: c, c: make(chan time.Time, 1)}
+	c.arm(t, d)
+	return t
+}
+
+// Advance moves the clock forward by d, firing every timer due on the way
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	target := c.now.Add(d)
+	for {
+		next := -1
+		for i, t := range c.waiters {
+			if !t.at.After(target) && (next < 0 || t.at.Before(c.waiters[next].at)) {
+				next = i
+			}
+		}
+		if next < 0 {
+			break
+		}
+
+		t := c.waiters[next]
+		c.now = t.at
+		select {
+		case t.c <- t.at:
+		default:
+		}
+		c.remove(t)
+	}
+	c.now = target
+}
+
+// BlockUntilArmed blocks until a timer is set to fire at at
+// Use it to make sure the cleaner has caught up before advancing the clock or checking its work
+func (c *FakeClock) BlockUntilArmed(at time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for !c.isArmed(at) {
+		c.armed.Wait()
+	}
+}
+
+// isArmed reports whether a timer is set to fire at at
+// Must be called with c.mu held
+func (c *FakeClock) isArmed(at time.Time) bool {
+	for _, t := range c.waiters {
+		if t.at.Equal(at) {
+			return true
+		}
+	}
+	return false
+}
+
+// arm schedules t, which must not be scheduled already, to fire d from now
+// Must be called with c.mu held
+func (c *FakeClock) arm(t *fakeTimer, d time.Duration) {
+	t.at = c.now.Add(d)
+	c.waiters = append(c.waiters, t)
+	c.armed.Broadcast()
+}
+
+// remove unschedules t and reports whether it was scheduled
+// Must be called with c.mu held
+func (c *FakeClock) remove(t *fakeTimer) bool {
+	for i, w := range c.waiters {
+		if w == t {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	c     chan time.Time
+	at    time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	return t.clock.remove(t)
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	active := t.clock.remove(t)
+	t.clock.arm(t, d)
+	return active
+}
@@ -1,26 +1,40 @@
 package main
 
 import (
+	"container/heap"
 	"context"
 	"sync"
 	"time"
 )
 
-type entry struct {
-	value string
+// maxExpireBatch bounds how many entries are expired under one write lock,
+// so readers are never stalled for long even when many keys expire at once
+const maxExpireBatch = 1024
+
+type entry[K comparable, V any] struct {
+	key   K
+	value V
 	ttl   time.Time
+	index int // position in the expiry heap, -1 if the entry doesn't expire
 }
-type TtlCache struct {
-	cache  map[string]entry
-	mu     *sync.RWMutex
-	cancel context.CancelFunc
+
+// TtlCache maps keys of type K to values of type V, each with an optional TTL
+type TtlCache[K comparable, V any] struct {
+	cache    map[K]*entry[K, V]
+	expiries expiryHeap[K, V]
+	mu       *sync.RWMutex
+	wake     chan struct{} // signals the cleaner that the soonest expiry changed
+	clock    Clock
+	cancel   context.CancelFunc
 }
 
-func NewTtlCache() *TtlCache {
+func NewTtlCache[K comparable, V any](opts ...Option) *TtlCache[K, V] {
 	ctx, cancel := context.WithCancel(context.Background())
-	c := &TtlCache{
-		cache:  make(map[string]entry),
+	c := &TtlCache[K, V]{
+		cache:  make(map[K]*entry[K, V]),
 		mu:     &sync.RWMutex{},
+		wake:   make(chan struct{}, 1),
+		clock:  newOptions(opts).clock,
 		cancel: cancel,
 	}
 
@@ -30,65 +44,128 @@ func NewTtlCache() *TtlCache {
 	return c
 }
 
-func (c *TtlCache) Set(key string, value string, ttl time.Duration) {
+func (c *TtlCache[K, V]) Set(key K, value V, ttl time.Duration) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	expiration := time.Time{}
 	if ttl > 0 {
-		expiration = time.Now().Add(ttl)
+		expiration = c.clock.Now().Add(ttl)
+	}
+
+	e, exists := c.cache[key]
+	if !exists {
+		e = &entry[K, V]{key: key, index: -1}
+		c.cache[key] = e
+	}
+	e.value = value
+	e.ttl = expiration
+
+	switch {
+	case e.index >= 0 && expiration.IsZero():
+		heap.Remove(&c.expiries, e.index)
+	case e.index >= 0:
+		heap.Fix(&c.expiries, e.index)
+	case !expiration.IsZero():
+		heap.Push(&c.expiries, e)
 	}
-	newEntry := entry{
-		value: value,
-		ttl:   expiration,
+	if e.index == 0 {
+		c.wakeCleaner()
 	}
-	c.cache[key] = newEntry
 }
 
-func (c *TtlCache) Get(key string) (string, bool) {
+// Get returns the value for key, or the zero value of V and false if it is missing or expired
+func (c *TtlCache[K, V]) Get(key K) (V, bool) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
+	var zero V
 	entry, exists := c.cache[key]
 	if !exists {
-		return "", false
+		return zero, false
 	}
 
 	//Checks if cache is expired
-	if !entry.ttl.IsZero() && time.Now().After(entry.ttl) {
-		return "", false
+	if !entry.ttl.IsZero() && c.clock.Now().After(entry.ttl) {
+		return zero, false
 	}
 
 	return entry.value, true
 }
 
-func (c *TtlCache) Delete(key string) {
+func (c *TtlCache[K, V]) Delete(key K) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	delete(c.cache, key)
+	if e, exists := c.cache[key]; exists {
+		c.remove(e)
+	}
 }
 
-func (c *TtlCache) Stop() {
+func (c *TtlCache[K, V]) Stop() {
 	c.cancel()
 }
 
-func (c *TtlCache) cleanupExpiredKeys(ctx context.Context) {
-	ticker := time.NewTicker(5 * time.Second)
+// remove deletes e from the map and the expiry heap
+// Must be called with the write lock held
+func (c *TtlCache[K, V]) remove(e *entry[K, V]) {
+	delete(c.cache, e.key)
+	if e.index >= 0 {
+		heap.Remove(&c.expiries, e.index)
+	}
+}
+
+// wakeCleaner tells the cleaner to recompute when to run, without blocking
+func (c *TtlCache[K, V]) wakeCleaner() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// cleanupExpiredKeys sleeps until the soonest expiry and removes the keys that expired by then
+// Only expired keys are visited, so the work is proportional to how many keys expire
+func (c *TtlCache[K, V]) cleanupExpiredKeys(ctx context.Context) {
+	timer := c.clock.NewTimer(0)
+	defer timer.Stop()
 
 	for {
 		select {
-		case <-ticker.C:
-			c.mu.Lock()
-			now := time.Now()
-			for key, entry := range c.cache {
-				if !entry.ttl.IsZero() && now.After(entry.ttl) {
-					delete(c.cache, key)
-				}
-			}
-			c.mu.Unlock()
+		case <-timer.C():
+		case <-c.wake:
+			timer.Stop()
 		case <-ctx.Done():
 			return
 		}
+
+		next, ok := c.expire()
+		for ok && next <= 0 {
+			// More keys expired than one batch holds, let waiting callers in between batches
+			next, ok = c.expire()
+		}
+		if ok {
+			timer.Reset(next)
+		}
+	}
+}
+
+// expire removes up to maxExpireBatch expired keys and returns how long until the next one expires
+// ok is false if no key is set to expire
+func (c *TtlCache[K, V]) expire() (next time.Duration, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.clock.Now()
+	for range maxExpireBatch {
+		if len(c.expiries) == 0 {
+			return 0, false
+		}
+		e := c.expiries[0]
+		if !now.After(e.ttl) {
+			// Expired once now is after ttl, like in Get
+			return e.ttl.Sub(now) + time.Nanosecond, true
+		}
+		c.remove(e)
 	}
+	return 0, len(c.expiries) > 0
 }
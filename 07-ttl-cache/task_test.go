@@ -1,13 +1,18 @@
 package main
 
 import (
+	"fmt"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
 )
 
+// epoch is where fake clocks start, any fixed time works
+var epoch = time.Unix(1_700_000_000, 0)
+
 func TestSetAndGet(t *testing.T) {
-	cache := NewTtlCache()
+	cache := NewTtlCache[string, string]()
 	defer cache.Stop()
 
 	cache.Set("key1", "value1", 0)
@@ -38,7 +43,7 @@ func TestSetAndGet(t *testing.T) {
 }
 
 func TestDelete(t *testing.T) {
-	cache := NewTtlCache()
+	cache := NewTtlCache[string, string]()
 	defer cache.Stop()
 
 	cache.Set("key1", "value1", 0)
@@ -57,7 +62,8 @@ func TestDelete(t *testing.T) {
 }
 
 func TestExpiration(t *testing.T) {
-	cache := NewTtlCache()
+	clock := NewFakeClock(epoch)
+	cache := NewTtlCache[string, string](WithClock(clock))
 	defer cache.Stop()
 
 	cache.Set("short", "shortvalue", 50*time.Millisecond)
@@ -69,8 +75,12 @@ func TestExpiration(t *testing.T) {
 		t.Error("Both keys should exist initially")
 	}
 
-	time.Sleep(100 * time.Millisecond)
+	clock.Advance(50 * time.Millisecond)
+	if _, ok := cache.Get("short"); !ok {
+		t.Error("Key should still exist at exactly its TTL")
+	}
 
+	clock.Advance(time.Nanosecond)
 	_, ok1 = cache.Get("short")
 	_, ok2 = cache.Get("forever")
 	if ok1 {
@@ -82,9 +92,11 @@ func TestExpiration(t *testing.T) {
 }
 
 func TestAutomaticCleanup(t *testing.T) {
-	cache := NewTtlCache()
+	clock := NewFakeClock(epoch)
+	cache := NewTtlCache[string, string](WithClock(clock))
 	defer cache.Stop()
 
+	cache.Set("late", "value", time.Hour)
 	cache.Set("expiring", "value", 1*time.Second)
 
 	val, ok := cache.Get("expiring")
@@ -92,16 +104,21 @@ func TestAutomaticCleanup(t *testing.T) {
 		t.Error("Key should exist initially")
 	}
 
-	time.Sleep(6 * time.Second)
+	// The cleaner sleeps until just after the soonest expiry, then until the next one
+	clock.BlockUntilArmed(epoch.Add(time.Second + time.Nanosecond))
+	clock.Advance(2 * time.Second)
+	clock.BlockUntilArmed(epoch.Add(time.Hour + time.Nanosecond))
 
-	_, ok = cache.Get("expiring")
+	cache.mu.RLock()
+	_, ok = cache.cache["expiring"]
+	cache.mu.RUnlock()
 	if ok {
 		t.Error("Expired key should have been automatically cleaned up")
 	}
 }
 
 func TestConcurrentAccess(t *testing.T) {
-	cache := NewTtlCache()
+	cache := NewTtlCache[string, string]()
 	defer cache.Stop()
 
 	var wg sync.WaitGroup
@@ -147,7 +164,7 @@ func TestConcurrentAccess(t *testing.T) {
 }
 
 func TestStopSafety(t *testing.T) {
-	cache := NewTtlCache()
+	cache := NewTtlCache[string, string]()
 
 	cache.Stop()
 
@@ -166,7 +183,7 @@ func TestStopSafety(t *testing.T) {
 }
 
 func TestEmptyStrings(t *testing.T) {
-	cache := NewTtlCache()
+	cache := NewTtlCache[string, string]()
 	defer cache.Stop()
 
 	cache.Set("", "empty key", 0)
@@ -195,15 +212,16 @@ func TestEmptyStrings(t *testing.T) {
 }
 
 func TestTtlUpdates(t *testing.T) {
-	cache := NewTtlCache()
+	clock := NewFakeClock(epoch)
+	cache := NewTtlCache[string, string](WithClock(clock))
 	defer cache.Stop()
 
 	cache.Set("key", "value", 100*time.Millisecond)
 
-	time.Sleep(50 * time.Millisecond)
+	clock.Advance(50 * time.Millisecond)
 	cache.Set("key", "value", 500*time.Millisecond)
 
-	time.Sleep(100 * time.Millisecond)
+	clock.Advance(100 * time.Millisecond)
 	val, ok := cache.Get("key")
 	if !ok {
 		t.Error("Key should not have expired after TTL update")
@@ -212,17 +230,17 @@ func TestTtlUpdates(t *testing.T) {
 		t.Errorf("Expected 'value', got '%s'", val)
 	}
 
-	time.Sleep(400 * time.Millisecond)
+	clock.Advance(450 * time.Millisecond)
 	_, ok = cache.Get("key")
 	if ok {
 		t.Error("Key should have expired after the updated TTL")
 	}
 
 	cache.Set("convert", "value", 100*time.Millisecond)
-	time.Sleep(50 * time.Millisecond)
+	clock.Advance(50 * time.Millisecond)
 	cache.Set("convert", "permanent", 0)
 
-	time.Sleep(100 * time.Millisecond)
+	clock.Advance(100 * time.Millisecond)
 	val, ok = cache.Get("convert")
 	if !ok {
 		t.Error("Key should not expire after conversion to non-expiring")
@@ -231,3 +249,122 @@ func TestTtlUpdates(t *testing.T) {
 		t.Errorf("Expected 'permanent', got '%s'", val)
 	}
 }
+
+func TestTypedValues(t *testing.T) {
+	type user struct {
+		Name string
+		Age  int
+	}
+
+	users := NewTtlCache[int, user]()
+	defer users.Stop()
+
+	users.Set(1, user{Name: "alice", Age: 30}, 0)
+	if u, ok := users.Get(1); !ok || u != (user{Name: "alice", Age: 30}) {
+		t.Errorf("Expected alice, got %+v, %v", u, ok)
+	}
+	if u, ok := users.Get(2); ok || u != (user{}) {
+		t.Errorf("Expected the zero user for a missing key, got %+v, %v", u, ok)
+	}
+
+	clock := NewFakeClock(epoch)
+	blobs := NewTtlCache[string, []byte](WithClock(clock))
+	defer blobs.Stop()
+
+	blobs.Set("blob", []byte{1, 2, 3}, 50*time.Millisecond)
+	if b, ok := blobs.Get("blob"); !ok || len(b) != 3 {
+		t.Errorf("Expected 3 bytes, got %v, %v", b, ok)
+	}
+	clock.Advance(100 * time.Millisecond)
+	if b, ok := blobs.Get("blob"); ok || b != nil {
+		t.Errorf("Expired key should return a nil slice, got %v, %v", b, ok)
+	}
+}
+
+func TestCleanupFollowsExpiryOrder(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	cache := NewTtlCache[string, string](WithClock(clock))
+	defer cache.Stop()
+
+	cache.Set("late", "value", time.Hour)
+	cache.Set("forever", "value", 0)
+	for i := range 100 {
+		cache.Set(fmt.Sprintf("key%d", i), "value", time.Duration(i%10+1)*10*time.Millisecond)
+	}
+	// Extending a TTL moves the key back in the expiry order, clearing it removes it
+	cache.Set("key0", "value", time.Hour)
+	cache.Set("key1", "value", 0)
+
+	// The soonest expiry is key10 and its peers, key0 was moved behind them
+	clock.BlockUntilArmed(epoch.Add(10*time.Millisecond + time.Nanosecond))
+	clock.Advance(time.Second)
+	clock.BlockUntilArmed(epoch.Add(time.Hour + time.Nanosecond))
+
+	cache.mu.RLock()
+	n, expiring := len(cache.cache), len(cache.expiries)
+	cache.mu.RUnlock()
+	if n != 4 || expiring != 2 {
+		t.Fatalf("Expired keys should be removed after their TTL, %d keys left, %d expiring", n, expiring)
+	}
+
+	for _, key := range []string{"late", "forever", "key0", "key1"} {
+		if _, ok := cache.Get(key); !ok {
+			t.Errorf("Key %s should not have expired", key)
+		}
+	}
+
+	cache.Delete("late")
+	cache.mu.RLock()
+	defer cache.mu.RUnlock()
+	if len(cache.expiries) != 1 || cache.expiries[0].key != "key0" {
+		t.Error("Deleted keys should be removed from the expiry heap")
+	}
+}
+
+// fill adds n keys to cache with TTLs spread over spread
+func fill(cache *TtlCache[string, string], n int, spread time.Duration) {
+	for i := range n {
+		cache.Set(strconv.Itoa(i), "value", spread*time.Duration(i%1000+1)/1000)
+	}
+}
+
+func BenchmarkSet1M(b *testing.B) {
+	cache := NewTtlCache[string, string]()
+	defer cache.Stop()
+	fill(cache, 1_000_000, time.Hour)
+
+	b.ResetTimer()
+	for i := range b.N {
+		cache.Set(strconv.Itoa(i%1_000_000), "value", time.Hour)
+	}
+}
+
+// BenchmarkGetDuringExpiration1M measures reads while a million keys expire under them
+func BenchmarkGetDuringExpiration1M(b *testing.B) {
+	cache := NewTtlCache[string, string]()
+	defer cache.Stop()
+	fill(cache, 1_000_000, time.Second)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var i int
+		for pb.Next() {
+			cache.Get(strconv.Itoa(i % 1_000_000))
+			i++
+		}
+	})
+}
+
+func BenchmarkExpire1M(b *testing.B) {
+	for range b.N {
+		b.StopTimer()
+		// No cleaner goroutine, so all the expiring happens below
+		cache := &TtlCache[string, string]{cache: make(map[string]*entry[string, string]), mu: &sync.RWMutex{}, wake: make(chan struct{}, 1), clock: systemClock{}}
+		fill(cache, 1_000_000, time.Millisecond)
+		time.Sleep(time.Millisecond)
+		b.StartTimer()
+
+		for _, ok := cache.expire(); ok; _, ok = cache.expire() {
+		}
+	}
+}